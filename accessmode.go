@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// ReadWriteOncePod is not part of the vendored API yet
+	ReadWriteOncePod v1.PersistentVolumeAccessMode = "ReadWriteOncePod"
+)
+
+// getAllowedAccessModes returns the access modes a storage class accepts,
+// from its comma separated accessModes parameter. Without the parameter every
+// access mode the volumes can serve is accepted.
+func getAllowedAccessModes(storageClass *storagev1.StorageClass) ([]v1.PersistentVolumeAccessMode, error) {
+	param, ok := storageClass.Parameters["accessModes"]
+	if !ok {
+		return []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany, ReadWriteOncePod}, nil
+	}
+	var allowed []v1.PersistentVolumeAccessMode
+	for _, s := range strings.Split(param, ",") {
+		mode := v1.PersistentVolumeAccessMode(strings.TrimSpace(s))
+		switch mode {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany, ReadWriteOncePod:
+			allowed = append(allowed, mode)
+		default:
+			return nil, fmt.Errorf("invalid accessModes parameter %q of storage class %v, unknown access mode %q", param, storageClass.Name, mode)
+		}
+	}
+	return allowed, nil
+}
+
+// validateAccessModes checks the access modes of a claim against the policy of
+// its storage class and what the volumes can serve. Volumes on nodePathMap
+// are pinned to one node, pods on that node can still share them read-only.
+// Only sharedFileSystemPath volumes are writable from several nodes.
+func validateAccessModes(modes []v1.PersistentVolumeAccessMode, storageClass *storagev1.StorageClass, sharedFS bool) error {
+	allowed, err := getAllowedAccessModes(storageClass)
+	if err != nil {
+		return err
+	}
+	for _, mode := range modes {
+		switch mode {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, ReadWriteOncePod:
+		case v1.ReadWriteMany:
+			if !sharedFS {
+				return fmt.Errorf("access mode %v requires sharedFileSystemPath, volumes on nodePathMap are only reachable from a single node", mode)
+			}
+		default:
+			return fmt.Errorf("unsupported access mode %v", mode)
+		}
+		if !containsAccessMode(allowed, mode) {
+			return fmt.Errorf("access mode %v is not allowed by storage class %v, allowed access modes are %v", mode, storageClass.Name, allowed)
+		}
+	}
+	return nil
+}
+
+func containsAccessMode(modes []v1.PersistentVolumeAccessMode, mode v1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
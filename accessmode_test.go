@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateAccessModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		param    *string
+		modes    []v1.PersistentVolumeAccessMode
+		sharedFS bool
+		wantErr  bool
+	}{
+		{
+			name:  "ReadWriteOnce by default",
+			modes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		},
+		{
+			name:  "ReadOnlyMany on a node",
+			modes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+		},
+		{
+			name:  "ReadWriteOncePod",
+			modes: []v1.PersistentVolumeAccessMode{ReadWriteOncePod},
+		},
+		{
+			name:    "ReadWriteMany on a node",
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			wantErr: true,
+		},
+		{
+			name:     "ReadWriteMany on a shared filesystem",
+			modes:    []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			sharedFS: true,
+		},
+		{
+			name:    "unknown access mode",
+			modes:   []v1.PersistentVolumeAccessMode{"ReadWriteSometimes"},
+			wantErr: true,
+		},
+		{
+			name:  "allowed by the storage class",
+			param: stringPtr("ReadWriteOnce, ReadOnlyMany"),
+			modes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+		},
+		{
+			name:    "not allowed by the storage class",
+			param:   stringPtr("ReadWriteOncePod"),
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			wantErr: true,
+		},
+		{
+			name:     "ReadWriteMany not allowed on a shared filesystem",
+			param:    stringPtr("ReadWriteOnce"),
+			modes:    []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			sharedFS: true,
+			wantErr:  true,
+		},
+		{
+			name:    "invalid accessModes parameter",
+			param:   stringPtr("ReadWriteOnce,Everything"),
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			wantErr: true,
+		},
+		{
+			name:    "one of several modes not allowed",
+			param:   stringPtr("ReadWriteOnce"),
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-path"}}
+			if tt.param != nil {
+				sc.Parameters = map[string]string{"accessModes": *tt.param}
+			}
+			err := validateAccessModes(tt.modes, sc, tt.sharedFS)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAccessModes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	ActionTypeCheck = "check"
+
+	// checkDirScript fails unless $1 is an existing directory
+	checkDirScript = `set -eu
+[ -d "$1" ] || { echo "$1 is not a directory"; exit 1; }`
+)
+
+func AdoptCmd() cli.Command {
+	return cli.Command{
+		Name:  "adopt",
+		Usage: "Import an existing host directory as a PV pre-bound to a claim",
+		Flags: append(provisionerFlags(),
+			cli.StringFlag{
+				Name:  FlagNode,
+				Usage: "Node holding the directory. Required unless sharedFileSystemPath is used.",
+			},
+			cli.StringFlag{
+				Name:  FlagPath,
+				Usage: "Required. Absolute path of the directory on the node.",
+			},
+			cli.StringFlag{
+				Name:  FlagPVC,
+				Usage: "Required. The claim (namespace/name) to bind the adopted volume to.",
+			},
+			cli.StringFlag{
+				Name:  FlagStorageClass,
+				Usage: "Storage class of the adopted volume. Defaults to the one of the claim.",
+			},
+			cli.StringFlag{
+				Name:  FlagCapacity,
+				Usage: "Capacity of the adopted volume. Defaults to the request of the claim.",
+			},
+			cli.StringFlag{
+				Name:  FlagVolumeType,
+				Usage: "local or hostPath. Defaults to the defaultVolumeType of the storage class.",
+			},
+		),
+		Action: func(c *cli.Context) {
+			if err := adoptVolume(c); err != nil {
+				logrus.Fatalf("Error adopting volume: %v", err)
+			}
+		},
+	}
+}
+
+func adoptVolume(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	path := filepath.Clean(c.String(FlagPath))
+	if !filepath.IsAbs(path) || path == "/" {
+		return fmt.Errorf("invalid flag %v %q, must be an absolute path other than /", FlagPath, c.String(FlagPath))
+	}
+	namespace, claimName, err := parseNamespacedName(c.String(FlagPVC))
+	if err != nil {
+		return errors.Wrapf(err, "invalid flag %v", FlagPVC)
+	}
+
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return err
+	}
+	var node *v1.Node
+	nodeName := c.String(FlagNode)
+	if !sharedFS {
+		if nodeName == "" {
+			return fmt.Errorf("invalid empty flag %v", FlagNode)
+		}
+		if node, err = p.kubeClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+	}
+
+	pv, err := p.newPreBoundVolume(node, namespace, claimName, c.String(FlagStorageClass), c.String(FlagCapacity), c.String(FlagVolumeType), sharedFS,
+		func(string) string { return path })
+	if err != nil {
+		return err
+	}
+
+	helperPod := p.newNodeHelperPod(ActionTypeCheck, nodeName, readOnlyMounts(filepath.Dir(path)), checkDirScript, []string{path})
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		return err
+	}
+	if _, err := p.kubeClient.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	fmt.Printf("Adopted %v as volume %v bound to claim %v/%v\n", path, pv.Name, namespace, claimName)
+	return nil
+}
+
+// newPreBoundVolume builds a PV for an existing directory on node, as Provision
+// would have created it for the claim namespace/claimName. Storage class and
+// capacity fall back to the ones of the claim if it already exists. The
+// directory is given by pathFor from the generated PV name.
+func (p *LocalPathProvisioner) newPreBoundVolume(node *v1.Node, namespace, claimName, storageClassName, capacity, volumeType string, sharedFS bool,
+	pathFor func(name string) string) (*v1.PersistentVolume, error) {
+	accessModes := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	claim, err := p.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claimName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		if claim.Spec.VolumeName != "" {
+			return nil, fmt.Errorf("claim %v/%v is already bound to volume %v", namespace, claimName, claim.Spec.VolumeName)
+		}
+		if storageClassName == "" && claim.Spec.StorageClassName != nil {
+			storageClassName = *claim.Spec.StorageClassName
+		}
+		if capacity == "" {
+			request := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+			capacity = request.String()
+		}
+		if len(claim.Spec.AccessModes) > 0 {
+			accessModes = claim.Spec.AccessModes
+		}
+	}
+	if storageClassName == "" {
+		return nil, fmt.Errorf("no storage class given and claim %v/%v does not specify one", namespace, claimName)
+	}
+	quantity, err := resource.ParseQuantity(capacity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid capacity %q", capacity)
+	}
+
+	storageClass, err := p.kubeClient.StorageV1().StorageClasses().Get(context.TODO(), storageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if storageClass.Provisioner != p.provisionerName {
+		return nil, fmt.Errorf("storage class %v is not served by %v", storageClassName, p.provisionerName)
+	}
+	if err := validateAccessModes(accessModes, storageClass, sharedFS); err != nil {
+		return nil, err
+	}
+	if volumeType == "" {
+		volumeType = getVolumeType(storageClass.GetAnnotations(), nil)
+	}
+
+	name := "pvc-" + string(uuid.NewUUID())
+	pv, err := newPersistentVolume(name, pathFor(name), volumeType, v1.PersistentVolumeFilesystem, node, sharedFS)
+	if err != nil {
+		return nil, err
+	}
+	pv.Annotations = map[string]string{annProvisionedBy: p.provisionerName}
+	if storageClass.Parameters["deleteMode"] == DeleteModeTrash {
+		pv.Annotations[AnnotationDeleteMode] = DeleteModeTrash
+	}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+	if storageClass.ReclaimPolicy != nil {
+		pv.Spec.PersistentVolumeReclaimPolicy = *storageClass.ReclaimPolicy
+	}
+	pv.Spec.StorageClassName = storageClassName
+	pv.Spec.AccessModes = accessModes
+	pv.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): quantity,
+	}
+	pv.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       claimName,
+	}
+	return pv, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+)
+
+const (
+	AnnotationCatalogVolume = "local.path.provisioner/catalog-volume"
+)
+
+var (
+	// CatalogReservationTimeout is how long a catalog volume handed out by
+	// Provision stays reserved for the claim while its PV is being created.
+	CatalogReservationTimeout = 1 * time.Minute
+)
+
+type CatalogVolumeData struct {
+	Name     string            `json:"name,omitempty"`
+	Node     string            `json:"node,omitempty"`
+	Path     string            `json:"path,omitempty"`
+	Capacity string            `json:"capacity,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// CatalogVolume is an existing directory registered in the config, which
+// claims with a matching selector are bound to instead of a new volume.
+type CatalogVolume struct {
+	Name     string
+	Node     string
+	Path     string
+	Capacity resource.Quantity
+	Labels   labels.Set
+}
+
+type catalogReservation struct {
+	pvName string
+	time   time.Time
+}
+
+func canonicalizeCatalog(data []*CatalogVolumeData, sharedFS bool) ([]*CatalogVolume, error) {
+	var catalog []*CatalogVolume
+	names := map[string]struct{}{}
+	for _, v := range data {
+		if v.Name == "" {
+			return nil, fmt.Errorf("catalog volume without name")
+		}
+		if _, ok := names[v.Name]; ok {
+			return nil, fmt.Errorf("duplicate catalog volume %v", v.Name)
+		}
+		names[v.Name] = struct{}{}
+		if sharedFS && v.Node != "" {
+			return nil, fmt.Errorf("catalog volume %v cannot have a node with sharedFileSystemPath", v.Name)
+		}
+		if !sharedFS && v.Node == "" {
+			return nil, fmt.Errorf("catalog volume %v has no node", v.Name)
+		}
+		if v.Path == "" || v.Path[0] != '/' {
+			return nil, fmt.Errorf("path must start with / for catalog volume %v", v.Name)
+		}
+		path := filepath.Clean(v.Path)
+		if path == "/" {
+			return nil, fmt.Errorf("cannot use root ('/') as path for catalog volume %v", v.Name)
+		}
+		capacity, err := resource.ParseQuantity(v.Capacity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capacity %q for catalog volume %v: %v", v.Capacity, v.Name, err)
+		}
+		catalog = append(catalog, &CatalogVolume{
+			Name:     v.Name,
+			Node:     v.Node,
+			Path:     path,
+			Capacity: capacity,
+			Labels:   labels.Set(v.Labels),
+		})
+	}
+	// prefer the smallest volume which fits, then the name for stable results
+	sort.SliceStable(catalog, func(i, j int) bool {
+		if c := catalog[i].Capacity.Cmp(catalog[j].Capacity); c != 0 {
+			return c < 0
+		}
+		return catalog[i].Name < catalog[j].Name
+	})
+	return catalog, nil
+}
+
+// catalogVolumesInUse returns the catalog volumes bound to a PV other than
+// pvName, or reserved for one.
+func (p *LocalPathProvisioner) catalogVolumesInUse(pvName string) (map[string]struct{}, error) {
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]struct{}{}
+	for _, pv := range pvs {
+		if name, ok := pv.Annotations[AnnotationCatalogVolume]; ok && pv.Name != pvName {
+			inUse[name] = struct{}{}
+		}
+	}
+	for name, r := range p.catalogReservations {
+		if r.pvName != pvName && time.Since(r.time) < CatalogReservationTimeout {
+			inUse[name] = struct{}{}
+		}
+	}
+	return inUse, nil
+}
+
+// provisionFromCatalog binds a claim with a selector to a free catalog volume
+// matching it. The directory already exists, so no setup script is run.
+func (p *LocalPathProvisioner) provisionFromCatalog(opts pvController.ProvisionOptions, sharedFS bool) (*v1.PersistentVolume, pvController.ProvisioningState, error) {
+	pvc := opts.PVC
+	// the claim was checked by validateClaim
+	selector, err := metav1.LabelSelectorAsSelector(pvc.Spec.Selector)
+	if err != nil {
+		return nil, pvController.ProvisioningFinished, fmt.Errorf("invalid claim.Spec.Selector: %v", err)
+	}
+	request := pvc.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+
+	p.catalogMutex.Lock()
+	defer p.catalogMutex.Unlock()
+
+	p.configMutex.RLock()
+	catalog := p.config.VolumeCatalog
+	p.configMutex.RUnlock()
+
+	inUse, err := p.catalogVolumesInUse(opts.PVName)
+	if err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
+	var entry *CatalogVolume
+	otherNodes := false
+	for _, v := range catalog {
+		if _, ok := inUse[v.Name]; ok || !selector.Matches(v.Labels) || v.Capacity.Cmp(request) < 0 {
+			continue
+		}
+		if opts.SelectedNode != nil && !sharedFS && v.Node != opts.SelectedNode.Name {
+			otherNodes = true
+			continue
+		}
+		entry = v
+		break
+	}
+	if entry == nil {
+		if otherNodes {
+			// let the scheduler try another node, the matching volumes are elsewhere
+			return nil, pvController.ProvisioningReschedule, fmt.Errorf("no free catalog volume matching the selector of claim %v/%v on node %v",
+				pvc.Namespace, pvc.Name, opts.SelectedNode.Name)
+		}
+		return nil, pvController.ProvisioningFinished, fmt.Errorf("no free catalog volume matching the selector of claim %v/%v with at least %v",
+			pvc.Namespace, pvc.Name, request.String())
+	}
+
+	node := opts.SelectedNode
+	if node == nil && !sharedFS {
+		if node, err = p.kubeClient.CoreV1().Nodes().Get(context.TODO(), entry.Node, metav1.GetOptions{}); err != nil {
+			return nil, pvController.ProvisioningFinished, err
+		}
+	}
+	// the directory exists already, but the volume counts towards the quotas
+	// like a new one
+	basePath := p.getBasePathForVolume(entry.Node, filepath.Clean(entry.Path))
+	if err := p.checkQuotas(pvc, opts.PVName, node, basePath, entry.Capacity); err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
+	pv, err := newPersistentVolume(opts.PVName, entry.Path, getVolumeType(opts.StorageClass.GetAnnotations(), pvc.GetAnnotations()),
+		v1.PersistentVolumeFilesystem, node, sharedFS)
+	if err != nil {
+		p.releaseQuotaReservation(opts.PVName)
+		return nil, pvController.ProvisioningFinished, err
+	}
+	pv.Annotations = map[string]string{AnnotationCatalogVolume: entry.Name}
+	pv.Spec.PersistentVolumeReclaimPolicy = *opts.StorageClass.ReclaimPolicy
+	pv.Spec.AccessModes = pvc.Spec.AccessModes
+	pv.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): entry.Capacity,
+	}
+	p.catalogReservations[entry.Name] = catalogReservation{pvName: opts.PVName, time: time.Now()}
+
+	volumeLog(pvc.Namespace, pvc.Name, opts.PVName, entry.Node).Infof("Binding claim %v/%v to catalog volume %v at %v:%v", pvc.Namespace, pvc.Name, entry.Name, entry.Node, entry.Path)
+	return pv, pvController.ProvisioningFinished, nil
+}
+
+// releaseCatalogVolume hands a catalog volume back to the catalog, leaving
+// its directory untouched.
+func (p *LocalPathProvisioner) releaseCatalogVolume(pv *v1.PersistentVolume) {
+	name := pv.Annotations[AnnotationCatalogVolume]
+	p.catalogMutex.Lock()
+	if r, ok := p.catalogReservations[name]; ok && r.pvName == pv.Name {
+		delete(p.catalogReservations, name)
+	}
+	p.catalogMutex.Unlock()
+	pvLog(pv, "").Infof("Released catalog volume %v of volume %v", name, pv.Name)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	slotGlobal        = "global"
+	slotNodePrefix    = "node/"
+	slotModelPull     = "model-pull"
+	slotModelPullNode = "model-pull-node/"
+)
+
+// HelperConcurrency limits the helper pods running at the same time, in the
+// cluster and on a single node, with separate limits for the helper pods
+// pulling models. Model pulls count against the general limits as well. 0
+// means no limit.
+type HelperConcurrency struct {
+	Global           int `json:"global,omitempty"`
+	PerNode          int `json:"perNode,omitempty"`
+	ModelPullGlobal  int `json:"modelPullGlobal,omitempty"`
+	ModelPullPerNode int `json:"modelPullPerNode,omitempty"`
+}
+
+func canonicalizeHelperConcurrency(data *HelperConcurrency) (HelperConcurrency, error) {
+	if data == nil {
+		return HelperConcurrency{}, nil
+	}
+	if data.Global < 0 || data.PerNode < 0 || data.ModelPullGlobal < 0 || data.ModelPullPerNode < 0 {
+		return HelperConcurrency{}, fmt.Errorf("helper concurrency limits cannot be negative")
+	}
+	return *data, nil
+}
+
+// limit returns the limit of slot, 0 when it is not limited.
+func (c HelperConcurrency) limit(slot string) int {
+	switch {
+	case slot == slotGlobal:
+		return c.Global
+	case slot == slotModelPull:
+		return c.ModelPullGlobal
+	case strings.HasPrefix(slot, slotModelPullNode):
+		return c.ModelPullPerNode
+	default:
+		return c.PerNode
+	}
+}
+
+func (p *LocalPathProvisioner) helperConcurrency() HelperConcurrency {
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+	if p.config == nil {
+		return HelperConcurrency{}
+	}
+	return p.config.HelperConcurrency
+}
+
+// shareHelperLimiter makes provisioners hand out the slots of one limiter, so
+// that the limits hold for the helper pods of every name served by the
+// process. The strictest limit of their configs applies.
+func shareHelperLimiter(provisioners []*LocalPathProvisioner) {
+	limiter := newHelperLimiter(func() HelperConcurrency {
+		var limits HelperConcurrency
+		for _, p := range provisioners {
+			c := p.helperConcurrency()
+			limits.Global = strictestLimit(limits.Global, c.Global)
+			limits.PerNode = strictestLimit(limits.PerNode, c.PerNode)
+			limits.ModelPullGlobal = strictestLimit(limits.ModelPullGlobal, c.ModelPullGlobal)
+			limits.ModelPullPerNode = strictestLimit(limits.ModelPullPerNode, c.ModelPullPerNode)
+		}
+		return limits
+	})
+	for _, p := range provisioners {
+		p.helperSlots = limiter
+	}
+}
+
+// strictestLimit returns the lower of two limits, 0 meaning no limit.
+func strictestLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// helperLimiter hands out the slots to run helper pods. Requests over a limit
+// wait in a queue and are served in the order they came in, a request whose
+// node is busy does not hold back the requests for other nodes though.
+type helperLimiter struct {
+	mutex   sync.Mutex
+	limits  func() HelperConcurrency
+	running map[string]int
+	queue   []*helperSlotRequest
+}
+
+type helperSlotRequest struct {
+	slots   []string
+	granted chan struct{}
+}
+
+func newHelperLimiter(limits func() HelperConcurrency) *helperLimiter {
+	return &helperLimiter{limits: limits, running: map[string]int{}}
+}
+
+// acquire waits until a helper pod may run on node, or until ctx is done. The
+// returned function hands the slot back.
+func (l *helperLimiter) acquire(ctx context.Context, node string, modelPull bool) (release func(), err error) {
+	r := &helperSlotRequest{slots: []string{slotGlobal}, granted: make(chan struct{})}
+	if node != "" {
+		r.slots = append(r.slots, slotNodePrefix+node)
+	}
+	if modelPull {
+		r.slots = append(r.slots, slotModelPull)
+		if node != "" {
+			r.slots = append(r.slots, slotModelPullNode+node)
+		}
+	}
+
+	l.mutex.Lock()
+	l.queue = append(l.queue, r)
+	l.dispatch()
+	l.mutex.Unlock()
+
+	release = func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for _, slot := range r.slots {
+			l.running[slot]--
+		}
+		l.dispatch()
+	}
+
+	select {
+	case <-r.granted:
+		return release, nil
+	default:
+	}
+	helperPodsQueued.Inc()
+	defer helperPodsQueued.Dec()
+	logrus.WithField(logFieldNode, node).Debugf("Waiting for a free helper pod slot")
+	select {
+	case <-r.granted:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-r.granted:
+		// granted in the meantime, the slot goes to the next request
+		for _, slot := range r.slots {
+			l.running[slot]--
+		}
+		l.dispatch()
+	default:
+		for i, queued := range l.queue {
+			if queued == r {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// update serves the queued requests which fit into changed limits.
+func (l *helperLimiter) update() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.dispatch()
+}
+
+// queued returns the number of requests waiting for a slot.
+func (l *helperLimiter) queued() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.queue)
+}
+
+// dispatch grants the slots to the queued requests which fit, in the order
+// they came in. It must be called with the mutex held.
+func (l *helperLimiter) dispatch() {
+	limits := l.limits()
+	var waiting []*helperSlotRequest
+	for _, r := range l.queue {
+		fits := true
+		for _, slot := range r.slots {
+			if limit := limits.limit(slot); limit > 0 && l.running[slot] >= limit {
+				fits = false
+				break
+			}
+		}
+		if !fits {
+			waiting = append(waiting, r)
+			continue
+		}
+		for _, slot := range r.slots {
+			l.running[slot]++
+		}
+		close(r.granted)
+	}
+	l.queue = waiting
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueHelperSlot requests a slot in the background once the requests before
+// it are queued, the request is sent on granted once it gets the slot.
+func queueHelperSlot(t *testing.T, l *helperLimiter, ctx context.Context, name, node string, modelPull bool, granted chan<- string, releases *sync.Map) {
+	queued := l.queued()
+	go func() {
+		release, err := l.acquire(ctx, node, modelPull)
+		if err != nil {
+			granted <- name + " " + err.Error()
+			return
+		}
+		releases.Store(name, release)
+		granted <- name
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.queued() == queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("request %v was not queued", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectGranted(t *testing.T, granted <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-granted:
+		if got != want {
+			t.Fatalf("granted %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v was not granted", want)
+	}
+}
+
+func expectNothingGranted(t *testing.T, granted <-chan string) {
+	t.Helper()
+	select {
+	case got := <-granted:
+		t.Fatalf("granted %v, want none", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func releaseHelperSlot(t *testing.T, releases *sync.Map, name string) {
+	t.Helper()
+	r, ok := releases.Load(name)
+	if !ok {
+		t.Fatalf("%v holds no slot", name)
+	}
+	r.(func())()
+}
+
+func TestHelperLimiterOrder(t *testing.T) {
+	l := newHelperLimiter(func() HelperConcurrency { return HelperConcurrency{Global: 1} })
+	ctx := context.Background()
+	releases := &sync.Map{}
+	granted := make(chan string, 10)
+
+	first, err := l.acquire(ctx, "node-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueHelperSlot(t, l, ctx, "second", "node-2", false, granted, releases)
+	queueHelperSlot(t, l, ctx, "third", "node-3", false, granted, releases)
+	expectNothingGranted(t, granted)
+
+	first()
+	expectGranted(t, granted, "second")
+	expectNothingGranted(t, granted)
+	releaseHelperSlot(t, releases, "second")
+	expectGranted(t, granted, "third")
+	releaseHelperSlot(t, releases, "third")
+	if l.running[slotGlobal] != 0 {
+		t.Errorf("%v global slots still running", l.running[slotGlobal])
+	}
+}
+
+func TestHelperLimiterBusyNode(t *testing.T) {
+	l := newHelperLimiter(func() HelperConcurrency { return HelperConcurrency{PerNode: 1} })
+	ctx := context.Background()
+	releases := &sync.Map{}
+	granted := make(chan string, 10)
+
+	first, err := l.acquire(ctx, "node-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueHelperSlot(t, l, ctx, "busy", "node-1", false, granted, releases)
+	// a request for another node goes past the one waiting for node-1
+	other, err := l.acquire(ctx, "node-2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+	expectNothingGranted(t, granted)
+
+	first()
+	expectGranted(t, granted, "busy")
+	releaseHelperSlot(t, releases, "busy")
+}
+
+func TestHelperLimiterModelPull(t *testing.T) {
+	l := newHelperLimiter(func() HelperConcurrency { return HelperConcurrency{Global: 2, ModelPullGlobal: 1} })
+	ctx := context.Background()
+	releases := &sync.Map{}
+	granted := make(chan string, 10)
+
+	pull, err := l.acquire(ctx, "node-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueHelperSlot(t, l, ctx, "second pull", "node-2", true, granted, releases)
+	// the model pull holds one of the two general slots
+	setup, err := l.acquire(ctx, "node-2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueHelperSlot(t, l, ctx, "third setup", "node-3", false, granted, releases)
+	expectNothingGranted(t, granted)
+
+	// the second pull still waits for the model pull slot, it does not hold
+	// back the setup behind it
+	setup()
+	expectGranted(t, granted, "third setup")
+	expectNothingGranted(t, granted)
+	pull()
+	expectGranted(t, granted, "second pull")
+	releaseHelperSlot(t, releases, "second pull")
+	releaseHelperSlot(t, releases, "third setup")
+}
+
+func TestHelperLimiterCancel(t *testing.T) {
+	l := newHelperLimiter(func() HelperConcurrency { return HelperConcurrency{Global: 1} })
+	releases := &sync.Map{}
+	granted := make(chan string, 10)
+
+	first, err := l.acquire(context.Background(), "node-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	queueHelperSlot(t, l, ctx, "cancelled", "node-1", false, granted, releases)
+	queueHelperSlot(t, l, context.Background(), "waiting", "node-1", false, granted, releases)
+	cancel()
+	expectGranted(t, granted, "cancelled "+context.Canceled.Error())
+
+	first()
+	expectGranted(t, granted, "waiting")
+	releaseHelperSlot(t, releases, "waiting")
+	if l.queued() != 0 || l.running[slotGlobal] != 0 {
+		t.Errorf("%v queued and %v running after all slots were released", l.queued(), l.running[slotGlobal])
+	}
+}
+
+func TestHelperLimiterUpdate(t *testing.T) {
+	var mutex sync.Mutex
+	limits := HelperConcurrency{Global: 1}
+	l := newHelperLimiter(func() HelperConcurrency {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return limits
+	})
+	ctx := context.Background()
+	releases := &sync.Map{}
+	granted := make(chan string, 10)
+
+	first, err := l.acquire(ctx, "node-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueHelperSlot(t, l, ctx, "second", "node-1", false, granted, releases)
+	expectNothingGranted(t, granted)
+
+	mutex.Lock()
+	limits.Global = 2
+	mutex.Unlock()
+	l.update()
+	expectGranted(t, granted, "second")
+	first()
+	releaseHelperSlot(t, releases, "second")
+}
+
+func TestStrictestLimit(t *testing.T) {
+	tests := []struct {
+		a, b, want int
+	}{
+		{0, 0, 0},
+		{0, 3, 3},
+		{3, 0, 3},
+		{2, 3, 2},
+		{3, 2, 2},
+	}
+	for _, tt := range tests {
+		if got := strictestLimit(tt.a, tt.b); got != tt.want {
+			t.Errorf("strictestLimit(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
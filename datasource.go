@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// getDataSourcePath returns the directory the volume of pvc should be
+// populated from, which must be reachable from node.
+func (p *LocalPathProvisioner) getDataSourcePath(pvc *v1.PersistentVolumeClaim, node string, sharedFS bool) (string, error) {
+	dataSource := pvc.Spec.DataSource
+	apiGroup := ""
+	if dataSource.APIGroup != nil {
+		apiGroup = *dataSource.APIGroup
+	}
+
+	switch {
+	case apiGroup == SnapshotGroup && dataSource.Kind == KindLocalVolumeSnapshot:
+		snap, err := p.getSnapshot(pvc.Namespace, dataSource.Name)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get snapshot %v/%v", pvc.Namespace, dataSource.Name)
+		}
+		if !snap.Status.ReadyToUse {
+			return "", fmt.Errorf("snapshot %v/%v is not ready to use", snap.Namespace, snap.Name)
+		}
+		if !sharedFS && snap.Status.Node != node {
+			return "", fmt.Errorf("snapshot %v/%v is stored on node %v and cannot be restored on node %v", snap.Namespace, snap.Name, snap.Status.Node, node)
+		}
+		return snap.Status.Path, nil
+	case apiGroup == "" && dataSource.Kind == "PersistentVolumeClaim":
+		return p.getClonePath(pvc.Namespace, dataSource.Name, node, sharedFS)
+	default:
+		return "", fmt.Errorf("unsupported data source %v %v", dataSource.Kind, dataSource.Name)
+	}
+}
+
+// getClonePath returns the directory of the volume bound to the source claim,
+// which must live on node unless the volumes are on a shared filesystem.
+func (p *LocalPathProvisioner) getClonePath(namespace, name, node string, sharedFS bool) (string, error) {
+	source, err := p.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get source claim %v/%v", namespace, name)
+	}
+	if source.Spec.VolumeName == "" {
+		return "", fmt.Errorf("source claim %v/%v is not bound yet", namespace, name)
+	}
+	pv, err := p.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), source.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get volume of source claim %v/%v", namespace, name)
+	}
+	if pv.Annotations[annProvisionedBy] != p.provisionerName {
+		return "", fmt.Errorf("source claim %v/%v is not provisioned by %v", namespace, name, p.provisionerName)
+	}
+	if isBlockVolume(pv) {
+		return "", fmt.Errorf("source claim %v/%v is a block volume and cannot be cloned", namespace, name)
+	}
+	path, sourceNode, err := p.getPathAndNodeForPV(pv)
+	if err != nil {
+		return "", err
+	}
+	if !sharedFS && sourceNode != node {
+		return "", fmt.Errorf("source claim %v/%v lives on node %v, cloning it to node %v needs a cross-node copy which is not supported", namespace, name, sourceNode, node)
+	}
+	return path, nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	ActionTypeMigrate = "migrate"
+	ActionTypeReceive = "receive"
+	ActionTypeSend    = "send"
+
+	// AnnotationDraining on a Node keeps new volumes off it, its value is the
+	// node its volumes are migrated to, if any
+	AnnotationDraining = "local.path.provisioner/draining"
+	// AnnotationMigrate set to true on a claim or a PV migrates its volume off
+	// a draining node even if its reclaim policy is not Retain
+	AnnotationMigrate = "local.path.provisioner/migrate"
+	// AnnotationMigratedFrom records the node and directory a migrated volume
+	// was copied from, the directory is left there
+	AnnotationMigratedFrom = "local.path.provisioner/migrated-from"
+
+	// transferPort is where the receiving helper pod listens for the data
+	transferPort = 7070
+
+	// receiveScript extracts the tar archive received on port $2 into the
+	// volume directory $1. The first line received must be the token $3, so
+	// that nothing but the sending helper pod can feed the archive. It prints
+	// the checksum of the archive.
+	receiveScript = `set -eu
+mkdir -p "$1"
+mkfifo /tmp/archive
+sha256sum < /tmp/archive | cut -d" " -f1 > /tmp/checksum &
+nc -l -p "$2" | {
+    read -r token
+    if [ "$token" != "$3" ]; then
+        echo "rejected a connection without the transfer token" >&2
+        exit 1
+    fi
+    tee /tmp/archive | tar -xf - -C "$1"
+}
+wait
+echo "checksum $(cat /tmp/checksum)"`
+
+	// sendScript streams the token $4 and the content of the volume directory
+	// $1 as a tar archive to port $3 of $2, retrying until the receiver
+	// listens. It prints the checksum of the directory archived once more
+	// after sending, which differs from the one received if anything wrote
+	// to the directory meanwhile.
+	sendScript = `set -u
+cd "$1" || exit 1
+i=0
+until { echo "$4"; tar -cf - .; } | nc "$2" "$3"; do
+    i=$((i+1))
+    [ "$i" -lt 30 ] || exit 1
+    sleep 1
+done
+echo "checksum $(tar -cf - . | sha256sum | cut -d" " -f1)"`
+)
+
+var (
+	// migratedPVDeleteTimeout is how long the PV of a migrated volume may take
+	// to go away before it is recreated
+	migratedPVDeleteTimeout = 30 * time.Second
+)
+
+// DrainReport lists what draining a node did with each of its volumes.
+type DrainReport struct {
+	Node     string          `json:"node"`
+	Target   string          `json:"target"`
+	Migrated []DrainedVolume `json:"migrated"`
+	Skipped  []DrainedVolume `json:"skipped"`
+	Failed   []DrainedVolume `json:"failed"`
+}
+
+// DrainedVolume is a volume of a draining node, Reason tells why it was
+// skipped or failed.
+type DrainedVolume struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Claim     string `json:"claim,omitempty"`
+	Path      string `json:"path"`
+	Target    string `json:"target,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// isDraining tells whether new volumes must be kept off node.
+func isDraining(node *v1.Node) bool {
+	_, ok := node.Annotations[AnnotationDraining]
+	return ok
+}
+
+// markDraining sets the draining annotation of node to target, or removes it
+// when undo is set.
+func (p *LocalPathProvisioner) markDraining(node, target string, undo bool) error {
+	var value interface{} = target
+	if undo {
+		value = nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]interface{}{AnnotationDraining: value}}})
+	_, err := p.kubeClient.CoreV1().Nodes().Patch(context.TODO(), node, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// drainNode migrates the Retain and opted-in volumes of node to target. A
+// volume is only migrated once no pod uses its claim, the others are skipped
+// and picked up by the next run. A volume which fails to migrate is reported
+// and the next one is tried.
+func (p *LocalPathProvisioner) drainNode(node, target string) (*DrainReport, error) {
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	if sharedFS {
+		return nil, fmt.Errorf("volumes on sharedFileSystemPath are reachable from every node, there is nothing to drain")
+	}
+	if target == "" || target == node {
+		return nil, fmt.Errorf("invalid target node %q to drain node %v to", target, node)
+	}
+	targetNode, err := p.kubeClient.CoreV1().Nodes().Get(context.TODO(), target, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if isDraining(targetNode) {
+		return nil, fmt.Errorf("target node %v is draining as well", target)
+	}
+	targetBase, err := p.getPathOnNode(target)
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DrainReport{Node: node, Target: target, Migrated: []DrainedVolume{}, Skipped: []DrainedVolume{}, Failed: []DrainedVolume{}}
+	for _, pv := range pvs {
+		path, pvNode, err := p.getPathAndNodeForPV(pv)
+		if err != nil || pvNode != node {
+			continue
+		}
+		path = filepath.Clean(path)
+		volume := DrainedVolume{Name: pv.Name, Path: path}
+		volume.Namespace, volume.Claim = pvClaim(pv)
+		reason, err := p.checkMigratable(pv)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			volume.Reason = reason
+			report.Skipped = append(report.Skipped, volume)
+			continue
+		}
+
+		rel, err := filepath.Rel(p.getBasePathForVolume(node, path), path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(path)
+		}
+		volume.Target = filepath.Join(targetBase, rel)
+		if err := p.migrateVolume(pv, node, path, targetNode, volume.Target); err != nil {
+			volume.Reason = err.Error()
+			report.Failed = append(report.Failed, volume)
+			continue
+		}
+		report.Migrated = append(report.Migrated, volume)
+	}
+	return report, nil
+}
+
+// checkMigratable returns why pv cannot be migrated yet, if so.
+func (p *LocalPathProvisioner) checkMigratable(pv *v1.PersistentVolume) (string, error) {
+	if isBlockVolume(pv) {
+		return "block volumes are not migrated", nil
+	}
+	if _, ok := pv.Annotations[AnnotationCatalogVolume]; ok {
+		return "catalog volumes are configured per node", nil
+	}
+	if pv.Status.Phase != v1.VolumeBound && pv.Status.Phase != v1.VolumeAvailable {
+		return fmt.Sprintf("volume is %v", pv.Status.Phase), nil
+	}
+	namespace, claimName := pvClaim(pv)
+	optedIn := pv.Annotations[AnnotationMigrate] == "true"
+	var pods []string
+	if claimName != "" {
+		pvc, err := p.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claimName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", err
+		}
+		if err == nil {
+			optedIn = optedIn || pvc.Annotations[AnnotationMigrate] == "true"
+		}
+		if pods, err = p.claimConsumers(namespace, claimName); err != nil {
+			return "", err
+		}
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain && !optedIn {
+		return fmt.Sprintf("reclaim policy is %v, annotate the claim with %v=true to migrate it", pv.Spec.PersistentVolumeReclaimPolicy, AnnotationMigrate), nil
+	}
+	if len(pods) > 0 {
+		return fmt.Sprintf("in use by pods %v, scale them down to migrate it", strings.Join(pods, ", ")), nil
+	}
+	return "", nil
+}
+
+// claimConsumers returns the pods of namespace which use the claim and have
+// not terminated.
+func (p *LocalPathProvisioner) claimConsumers(namespace, claimName string) ([]string, error) {
+	podList, err := p.kubeClient.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pods []string
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claimName {
+				pods = append(pods, pod.Name)
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+// migrateVolume copies the directory of pv to dst on target, then replaces pv
+// with a PV of the same name pointing there, which the claim binds to again.
+// The directory on node is left in place.
+func (p *LocalPathProvisioner) migrateVolume(pv *v1.PersistentVolume, node, path string, target *v1.Node, dst string) error {
+	namespace, claimName := pvClaim(pv)
+	log := volumeLog(namespace, claimName, pv.Name, node).WithField(logFieldAction, ActionTypeMigrate)
+	log.Infof("Copying volume %v from %v:%v to %v:%v", pv.Name, node, path, target.Name, dst)
+	if err := p.transferVolumeData(node, path, target.Name, dst); err != nil {
+		p.removeTransferred(target.Name, dst)
+		return err
+	}
+	// a pod started during the copy may have written to the directory since
+	// it was archived, the old PV must not be swapped from under it
+	if claimName != "" {
+		pods, err := p.claimConsumers(namespace, claimName)
+		if err != nil {
+			p.removeTransferred(target.Name, dst)
+			return err
+		}
+		if len(pods) > 0 {
+			p.removeTransferred(target.Name, dst)
+			return fmt.Errorf("pods %v started using the claim during the copy, scale them down to migrate it", strings.Join(pods, ", "))
+		}
+	}
+
+	volumeType := "hostPath"
+	if pv.Spec.Local != nil {
+		volumeType = "local"
+	}
+	migrated, err := newPersistentVolume(pv.Name, dst, volumeType, v1.PersistentVolumeFilesystem, target, false)
+	if err != nil {
+		return err
+	}
+	migrated.Labels = pv.Labels
+	migrated.Annotations = map[string]string{}
+	for k, v := range pv.Annotations {
+		switch k {
+		case AnnotationHealth, AnnotationFilesystemID, AnnotationUsedBytes, AnnotationUsageReported:
+			// measured on the old directory
+		default:
+			migrated.Annotations[k] = v
+		}
+	}
+	migrated.Annotations[AnnotationMigratedFrom] = node + ":" + path
+	migrated.Spec.AccessModes = pv.Spec.AccessModes
+	migrated.Spec.Capacity = pv.Spec.Capacity
+	migrated.Spec.StorageClassName = pv.Spec.StorageClassName
+	migrated.Spec.MountOptions = pv.Spec.MountOptions
+	migrated.Spec.PersistentVolumeReclaimPolicy = pv.Spec.PersistentVolumeReclaimPolicy
+	if pv.Spec.ClaimRef != nil {
+		migrated.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       pv.Spec.ClaimRef.Kind,
+			APIVersion: pv.Spec.ClaimRef.APIVersion,
+			Namespace:  pv.Spec.ClaimRef.Namespace,
+			Name:       pv.Spec.ClaimRef.Name,
+			UID:        pv.Spec.ClaimRef.UID,
+		}
+	}
+
+	// the PV is retained and its protection lifted, so removing it neither
+	// tears down the directory nor waits for the claim to go away
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"finalizers": nil},
+		"spec":     map[string]interface{}{"persistentVolumeReclaimPolicy": v1.PersistentVolumeReclaimRetain},
+	})
+	pvs := p.kubeClient.CoreV1().PersistentVolumes()
+	if _, err := pvs.Patch(context.TODO(), pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	if err := pvs.Delete(context.TODO(), pv.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	deadline := time.Now().Add(migratedPVDeleteTimeout)
+	for {
+		_, err := pvs.Get(context.TODO(), pv.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("volume %v was not removed after %v, the data was copied to %v:%v", pv.Name, migratedPVDeleteTimeout, target.Name, dst)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; ; i++ {
+		if _, err = pvs.Create(context.TODO(), migrated, metav1.CreateOptions{}); err == nil || i == 4 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "volume %v was removed but could not be recreated on %v:%v, the data is on both nodes", pv.Name, target.Name, dst)
+	}
+
+	log.Infof("Volume %v has been migrated to %v:%v", pv.Name, target.Name, dst)
+	if pv.Spec.ClaimRef != nil {
+		p.eventRecorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeNormal, "VolumeMigrated", "volume %v migrated from %v:%v to %v:%v", pv.Name, node, path, target.Name, dst)
+	}
+	return nil
+}
+
+// transferVolumeData copies the directory src on node from into dst on node
+// to, streaming a tar archive between two helper pods over the pod network.
+// The receiver only accepts a stream starting with a random token, and the
+// checksums of the archive on both sides must match.
+func (p *LocalPathProvisioner) transferVolumeData(from, src, to, dst string) error {
+	port := strconv.Itoa(transferPort)
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	receiver := p.newNodeHelperPod(ActionTypeReceive, to, createMounts(filepath.Dir(dst)), receiveScript, []string{dst, port, token})
+	received := make(chan error, 1)
+	var receivedOutput string
+	go func() {
+		var err error
+		receivedOutput, err = p.runHelperPod(receiver)
+		received <- err
+	}()
+	ip, err := p.waitForPodIP(receiver.Name, received)
+	if err != nil {
+		return errors.Wrapf(err, "failed to receive %v on node %v", dst, to)
+	}
+
+	sender := p.newNodeHelperPod(ActionTypeSend, from, readOnlyMounts(src), sendScript, []string{src, ip, port, token})
+	sentOutput, err := p.runHelperPod(sender)
+	if err != nil {
+		// the receiver would otherwise wait until it times out
+		p.kubeClient.CoreV1().Pods(p.namespace).Delete(context.TODO(), receiver.Name, metav1.DeleteOptions{})
+		<-received
+		return errors.Wrapf(err, "failed to send %v from node %v", src, from)
+	}
+	if err := <-received; err != nil {
+		return errors.Wrapf(err, "failed to receive %v on node %v", dst, to)
+	}
+	sent, got := transferChecksum(sentOutput), transferChecksum(receivedOutput)
+	if sent == "" || sent != got {
+		return fmt.Errorf("the copy of %v on node %v does not match the directory on node %v, it was modified during the copy or the transfer was corrupted", dst, to, from)
+	}
+	return nil
+}
+
+// transferChecksum returns the checksum printed by sendScript or
+// receiveScript.
+func transferChecksum(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "checksum ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "checksum "))
+		}
+	}
+	return ""
+}
+
+// removeTransferred removes the incomplete or stale copy dst on node.
+func (p *LocalPathProvisioner) removeTransferred(node, dst string) {
+	helperPod := p.newNodeHelperPod(ActionTypeCleanup, node, existingMounts(filepath.Dir(dst)), cleanupScript, []string{dst})
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		logrus.Errorf("failed to remove the copy %v on node %v, remove it by hand: %v", dst, node, err)
+	}
+}
+
+// waitForPodIP waits for the helper pod name to run and returns its IP. done
+// yields the result of the helper pod if it ends before.
+func (p *LocalPathProvisioner) waitForPodIP(name string, done <-chan error) (string, error) {
+	for i := 0; i < p.config.CmdTimeoutSeconds; i++ {
+		pod, err := p.kubeClient.CoreV1().Pods(p.namespace).Get(p.helperCtx, name, metav1.GetOptions{})
+		if err == nil && pod.Status.Phase == v1.PodRunning && pod.Status.PodIP != "" {
+			return pod.Status.PodIP, nil
+		}
+		select {
+		case err := <-done:
+			if err == nil {
+				err = fmt.Errorf("helper pod %v ended before receiving anything", name)
+			}
+			return "", err
+		case <-time.After(time.Second):
+		}
+	}
+	return "", fmt.Errorf("helper pod %v is not running after %v seconds", name, p.config.CmdTimeoutSeconds)
+}
+
+func (p *LocalPathProvisioner) watchAndDrainNodes(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.drainAnnotatedNodes(); err != nil {
+					logrus.Errorf("failed to drain nodes: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop draining nodes")
+				return
+			}
+		}
+	}()
+}
+
+// drainAnnotatedNodes drains the nodes whose draining annotation names a
+// target node.
+func (p *LocalPathProvisioner) drainAnnotatedNodes() error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes.Items {
+		target := node.Annotations[AnnotationDraining]
+		if target == "" {
+			continue
+		}
+		report, err := p.drainNode(node.Name, target)
+		if err != nil {
+			logrus.Errorf("failed to drain node %v to %v: %v", node.Name, target, err)
+			continue
+		}
+		logDrainReport(report)
+	}
+	return nil
+}
+
+func logDrainReport(report *DrainReport) {
+	for _, v := range report.Migrated {
+		drainedVolumeLog(v).Infof("Volume %v migrated from %v to %v:%v", v.Name, report.Node, report.Target, v.Target)
+	}
+	for _, v := range report.Skipped {
+		drainedVolumeLog(v).Debugf("Volume %v left on draining node %v: %v", v.Name, report.Node, v.Reason)
+	}
+	for _, v := range report.Failed {
+		drainedVolumeLog(v).Errorf("failed to migrate volume %v from %v to %v: %v", v.Name, report.Node, report.Target, v.Reason)
+	}
+	if len(report.Migrated) > 0 || len(report.Skipped) > 0 || len(report.Failed) > 0 {
+		logrus.Infof("Draining node %v to %v migrated %d volumes, %d left on the node, %d failed",
+			report.Node, report.Target, len(report.Migrated), len(report.Skipped), len(report.Failed))
+	}
+}
+
+func drainedVolumeLog(v DrainedVolume) *logrus.Entry {
+	return volumeLog(v.Namespace, v.Claim, v.Name, "").WithField(logFieldAction, ActionTypeMigrate)
+}
+
+func printDrainReport(w io.Writer, report *DrainReport, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	fmt.Fprintf(w, "Migrated volumes: %d\n", len(report.Migrated))
+	for _, v := range report.Migrated {
+		fmt.Fprintf(w, "  %v\t%v/%v\t%v -> %v:%v\n", v.Name, v.Namespace, v.Claim, v.Path, report.Target, v.Target)
+	}
+	fmt.Fprintf(w, "Volumes left on node %v: %d\n", report.Node, len(report.Skipped))
+	for _, v := range report.Skipped {
+		fmt.Fprintf(w, "  %v\t%v/%v\t%v\n", v.Name, v.Namespace, v.Claim, v.Reason)
+	}
+	if len(report.Failed) > 0 {
+		fmt.Fprintf(w, "Failed volumes: %d\n", len(report.Failed))
+		for _, v := range report.Failed {
+			fmt.Fprintf(w, "  %v\t%v/%v\t%v\n", v.Name, v.Namespace, v.Claim, v.Reason)
+		}
+	}
+	return nil
+}
+
+func DrainNodeCmd() cli.Command {
+	return cli.Command{
+		Name:  "drain-node",
+		Usage: "Keep new volumes off a node and migrate its Retain or opted-in volumes to another node",
+		Flags: append(provisionerFlags(),
+			cli.StringFlag{
+				Name:  FlagNode,
+				Usage: "Required. The node to drain.",
+			},
+			cli.StringFlag{
+				Name:  FlagTargetNode,
+				Usage: "Node to migrate the volumes to. Without it the node is only marked as draining.",
+			},
+			cli.BoolFlag{
+				Name:  FlagUndo,
+				Usage: "Remove the draining mark of the node, new volumes may land on it again.",
+			},
+			cli.StringFlag{
+				Name:  FlagFormat,
+				Usage: "Output format of the report, text or json.",
+				Value: "text",
+			},
+		),
+		Action: func(c *cli.Context) {
+			if err := runDrainNode(c, os.Stdout); err != nil {
+				logrus.Fatalf("Error draining node: %v", err)
+			}
+		},
+	}
+}
+
+func runDrainNode(c *cli.Context, out io.Writer) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	node := c.String(FlagNode)
+	if node == "" {
+		return fmt.Errorf("invalid empty flag %v", FlagNode)
+	}
+	target := c.String(FlagTargetNode)
+	if c.Bool(FlagUndo) && target != "" {
+		return fmt.Errorf("flag %v cannot be combined with flag %v", FlagUndo, FlagTargetNode)
+	}
+	format := c.String(FlagFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid flag %v %q, must be text or json", FlagFormat, format)
+	}
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	if err := p.markDraining(node, target, c.Bool(FlagUndo)); err != nil {
+		return err
+	}
+	if c.Bool(FlagUndo) {
+		fmt.Fprintf(out, "Node %v is no longer draining\n", node)
+		return nil
+	}
+	if target == "" {
+		fmt.Fprintf(out, "Node %v is draining, no new volumes are placed on it\n", node)
+		return nil
+	}
+	report, err := p.drainNode(node, target)
+	if err != nil {
+		return err
+	}
+	if err := printDrainReport(out, report, format); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d volumes of node %v failed to migrate", len(report.Failed), node)
+	}
+	return nil
+}
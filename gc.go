@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var (
+	DefaultGCGracePeriod = 24 * time.Hour
+)
+
+// collectGarbage returns the orphan directories which were not modified for
+// gracePeriod. reconcile only reports the directories created by Provision.
+func (p *LocalPathProvisioner) collectGarbage(gracePeriod time.Duration) ([]OrphanDirectory, error) {
+	report, err := p.reconcile()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-gracePeriod)
+	var garbage []OrphanDirectory
+	for _, o := range report.Orphans {
+		if o.Modified.After(cutoff) {
+			logrus.Debugf("skip %v:%v which is in its grace period", o.Node, o.Path)
+			continue
+		}
+		garbage = append(garbage, o)
+	}
+	return garbage, nil
+}
+
+// checkGracePeriod rejects a grace period shorter than orphanMinAge, as
+// reconcile never reports the directories modified more recently.
+func checkGracePeriod(gracePeriod time.Duration) error {
+	if gracePeriod < orphanMinAge {
+		return fmt.Errorf("invalid duration flag %v %v, directories modified during the last %v may belong to a volume being provisioned and are never removed", FlagGracePeriod, gracePeriod, orphanMinAge)
+	}
+	return nil
+}
+
+func GCCmd() cli.Command {
+	return cli.Command{
+		Name:  "gc",
+		Usage: "Remove the volume directories left behind without PV, prints the plan unless --apply is given",
+		Flags: append(provisionerFlags(),
+			cli.DurationFlag{
+				Name:  FlagGracePeriod,
+				Usage: "Only directories not modified for this long are removed, at least 1h.",
+				Value: DefaultGCGracePeriod,
+			},
+			cli.BoolFlag{
+				Name:  FlagApply,
+				Usage: "Remove the directories instead of printing the plan.",
+			},
+		),
+		Action: func(c *cli.Context) {
+			if err := runGC(c); err != nil {
+				logrus.Fatalf("Error collecting orphan directories: %v", err)
+			}
+		},
+	}
+}
+
+func runGC(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	gracePeriod := c.Duration(FlagGracePeriod)
+	if err := checkGracePeriod(gracePeriod); err != nil {
+		return err
+	}
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	garbage, err := p.collectGarbage(gracePeriod)
+	if err != nil {
+		return err
+	}
+	if !c.Bool(FlagApply) {
+		for _, o := range garbage {
+			fmt.Printf("would remove %v:%v\tmodified %v\n", o.Node, o.Path, o.Modified.Format(time.RFC3339))
+		}
+		fmt.Printf("%d directories would be removed, run with --%v to remove them\n", len(garbage), FlagApply)
+		return nil
+	}
+	removed, err := p.removeOrphans(garbage)
+	if err != nil {
+		return err
+	}
+	for _, o := range removed {
+		fmt.Printf("removed %v:%v\n", o.Node, o.Path)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckGracePeriod(t *testing.T) {
+	tests := []struct {
+		gracePeriod time.Duration
+		wantErr     bool
+	}{
+		{DefaultGCGracePeriod, false},
+		{orphanMinAge, false},
+		{10 * time.Minute, true},
+		{0, true},
+		{-time.Hour, true},
+	}
+	for _, tt := range tests {
+		if err := checkGracePeriod(tt.gracePeriod); (err != nil) != tt.wantErr {
+			t.Errorf("checkGracePeriod(%v) error = %v, wantErr %v", tt.gracePeriod, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	ActionTypeHealth = "health"
+
+	AnnotationHealth       = "local.path.provisioner/health"
+	AnnotationFilesystemID = "local.path.provisioner/filesystem-id"
+
+	volumeHealthy = "Healthy"
+
+	healthMissing  = "missing"
+	healthReadOnly = "readonly"
+	healthOK       = "ok"
+
+	// healthScript prints the status, the filesystem id and the path of every
+	// volume directory passed as argument
+	healthScript = `set -u
+for dir in "$@"; do
+    if [ ! -d "$dir" ]; then
+        echo "missing - $dir"
+        continue
+    fi
+    fsid=$(stat -f -c %i "$dir" 2>/dev/null || echo -)
+    probe="$dir/.local-path-health-check"
+    if touch "$probe" 2>/dev/null && rm -f "$probe"; then
+        echo "ok $fsid $dir"
+    else
+        echo "readonly $fsid $dir"
+    fi
+done`
+)
+
+type volumeHealth struct {
+	status string
+	fsid   string
+}
+
+func (p *LocalPathProvisioner) watchAndCheckHealth(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.checkHealth(); err != nil {
+					logrus.Errorf("failed to check volume health: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop checking volume health")
+				return
+			}
+		}
+	}()
+}
+
+// checkHealth verifies that the directory of every provisioned volume exists,
+// is writable and is still on the filesystem it was first seen on, one helper
+// pod per node.
+func (p *LocalPathProvisioner) checkHealth() error {
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return err
+	}
+
+	pvsByNode := map[string]map[string]*v1.PersistentVolume{}
+	for _, pv := range pvs {
+		path, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil {
+			logrus.Debugf("skip health of volume %v: %v", pv.Name, err)
+			continue
+		}
+		if pvsByNode[node] == nil {
+			pvsByNode[node] = map[string]*v1.PersistentVolume{}
+		}
+		pvsByNode[node][path] = pv
+	}
+
+	for node, pvsByPath := range pvsByNode {
+		var paths []string
+		for path := range pvsByPath {
+			paths = append(paths, path)
+		}
+		results, err := p.probeVolumes(node, paths)
+		if err != nil {
+			logrus.Errorf("failed to check volume health on node %v: %v", node, err)
+			continue
+		}
+		for path, pv := range pvsByPath {
+			if h, ok := results[path]; ok {
+				p.recordHealth(pv, node, h)
+			}
+		}
+	}
+	// drop the series of volumes which are gone
+	p.abnormalSeries.flush()
+	return nil
+}
+
+// probeVolumes returns the health of each of paths on node. The parent
+// directories are mounted only if they exist, the paths under a missing one,
+// e.g. the mount point of a disk which is gone, are missing too.
+func (p *LocalPathProvisioner) probeVolumes(node string, paths []string) (map[string]volumeHealth, error) {
+	results := map[string]volumeHealth{}
+	for len(paths) > 0 {
+		parents := map[string]struct{}{}
+		for _, path := range paths {
+			parents[filepath.Dir(path)] = struct{}{}
+		}
+		var dirs []string
+		for dir := range parents {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+
+		helperPod := p.newNodeHelperPod(ActionTypeHealth, node, existingMounts(dirs...), healthScript, paths)
+		output, err := p.runHelperPod(helperPod)
+		mountErr, ok := err.(*helperMountError)
+		if !ok {
+			if err != nil {
+				return nil, err
+			}
+			parseHealthOutput(output, results)
+			break
+		}
+		missing := map[string]bool{}
+		for _, dir := range mountErr.dirs {
+			missing[dir] = true
+		}
+		var remaining []string
+		for _, path := range paths {
+			if missing[filepath.Dir(path)] {
+				results[path] = volumeHealth{status: healthMissing, fsid: "-"}
+			} else {
+				remaining = append(remaining, path)
+			}
+		}
+		if len(remaining) == len(paths) {
+			return nil, err
+		}
+		paths = remaining
+	}
+	return results, nil
+}
+
+func parseHealthOutput(output string, results map[string]volumeHealth) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		results[fields[2]] = volumeHealth{status: fields[0], fsid: fields[1]}
+	}
+}
+
+func (p *LocalPathProvisioner) recordHealth(pv *v1.PersistentVolume, node string, h volumeHealth) {
+	expectedFSID := pv.Annotations[AnnotationFilesystemID]
+	reason := ""
+	switch {
+	case h.status == healthMissing:
+		reason = "volume directory is missing"
+	case h.status == healthReadOnly:
+		reason = "volume directory is not writable"
+	case h.status != healthOK:
+		reason = fmt.Sprintf("unknown status %v", h.status)
+	case expectedFSID != "" && h.fsid != "-" && h.fsid != expectedFSID:
+		reason = fmt.Sprintf("volume directory moved from filesystem %v to %v, the disk may have been remounted or replaced", expectedFSID, h.fsid)
+	}
+
+	namespace, claim := pvClaim(pv)
+	health := volumeHealthy
+	abnormal := 0.0
+	if reason != "" {
+		health = "Abnormal: " + reason
+		abnormal = 1
+	}
+	p.abnormalSeries.set(abnormal, p.provisionerName, namespace, claim, pv.Name, node)
+
+	// the filesystem a volume is first seen on is the expected one
+	annotations := map[string]string{}
+	previous := pv.Annotations[AnnotationHealth]
+	if previous != health {
+		annotations[AnnotationHealth] = health
+	}
+	if expectedFSID == "" && h.status == healthOK && h.fsid != "-" {
+		annotations[AnnotationFilesystemID] = h.fsid
+	}
+	if len(annotations) > 0 {
+		patch, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+		_, err := p.kubeClient.CoreV1().PersistentVolumes().Patch(context.TODO(), pv.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			logrus.Errorf("failed to annotate health of volume %v: %v", pv.Name, err)
+		}
+	}
+
+	if reason != "" {
+		volumeLog(namespace, claim, pv.Name, node).Warnf("Volume %v on node %v is abnormal: %v", pv.Name, node, reason)
+		if pv.Spec.ClaimRef != nil {
+			p.eventRecorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeWarning, "VolumeAbnormal", "volume %v on node %v: %v", pv.Name, node, reason)
+		}
+	} else if previous != "" && previous != volumeHealthy {
+		volumeLog(namespace, claim, pv.Name, node).Infof("Volume %v on node %v recovered", pv.Name, node)
+		if pv.Spec.ClaimRef != nil {
+			p.eventRecorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeNormal, "VolumeRecovered", "volume %v on node %v is healthy again", pv.Name, node)
+		}
+	}
+}
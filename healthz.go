@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// stalledAfterTimeouts is how many helper command timeouts an operation
+	// may take before its worker is considered stalled, an operation runs a
+	// few helper pods at most
+	stalledAfterTimeouts = 5
+)
+
+// operationTracker keeps the start time of the operations in flight, e.g.
+// provisioning a volume, to detect workers which are stuck.
+type operationTracker struct {
+	mutex    sync.Mutex
+	next     uint64
+	inflight map[uint64]trackedOperation
+}
+
+type trackedOperation struct {
+	name   string
+	start  time.Time
+	volume bool
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{inflight: map[uint64]trackedOperation{}}
+}
+
+// begin records the start of an operation and returns the function to call
+// when it is done.
+func (t *operationTracker) begin(format string, args ...interface{}) func() {
+	return t.track(trackedOperation{name: fmt.Sprintf(format, args...), start: time.Now()})
+}
+
+// beginVolume records the start of an operation on a volume, which may wait
+// for helper pod slots.
+func (t *operationTracker) beginVolume(format string, args ...interface{}) func() {
+	return t.track(trackedOperation{name: fmt.Sprintf(format, args...), start: time.Now(), volume: true})
+}
+
+func (t *operationTracker) track(op trackedOperation) func() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	id := t.next
+	t.next++
+	t.inflight[id] = op
+	return func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		delete(t.inflight, id)
+	}
+}
+
+// count returns the number of operations in flight.
+func (t *operationTracker) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.inflight)
+}
+
+// stalled returns the operations running for longer than timeout. Volume
+// operations are skipped with skipVolumes, when they may be waiting for
+// helper pod slots rather than being stuck.
+func (t *operationTracker) stalled(timeout time.Duration, skipVolumes bool) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var stalled []string
+	for _, op := range t.inflight {
+		if op.volume && skipVolumes {
+			continue
+		}
+		if d := time.Since(op.start); d > timeout {
+			stalled = append(stalled, fmt.Sprintf("%v running for %v", op.name, d.Round(time.Second)))
+		}
+	}
+	sort.Strings(stalled)
+	return stalled
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthServer serves /healthz, failing when a worker is stalled, and
+// /readyz, failing without a valid config, without API server or, with
+// leader election, on the replicas which are not leading. Single checks are
+// skipped with ?exclude=<name>, e.g. /readyz?exclude=leadership.
+type healthServer struct {
+	provisioners []*LocalPathProvisioner
+	leaderElect  bool
+	leading      int32
+}
+
+func newHealthServer(provisioners []*LocalPathProvisioner, leaderElect bool) *healthServer {
+	return &healthServer{provisioners: provisioners, leaderElect: leaderElect}
+}
+
+func (s *healthServer) setLeading() {
+	atomic.StoreInt32(&s.leading, 1)
+}
+
+func (s *healthServer) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "workers", check: func(ctx context.Context) error {
+			var stalled []string
+			for _, p := range s.provisioners {
+				p.configMutex.RLock()
+				timeout := time.Duration(stalledAfterTimeouts*p.config.CmdTimeoutSeconds) * time.Second
+				p.configMutex.RUnlock()
+				// the helper pods themselves are checked while others wait
+				// for a slot
+				stalled = append(stalled, p.operations.stalled(timeout, p.helperSlots.queued() > 0)...)
+			}
+			if len(stalled) > 0 {
+				return fmt.Errorf("stalled: %v", strings.Join(stalled, ", "))
+			}
+			return nil
+		}},
+	}
+}
+
+func (s *healthServer) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "config", check: func(ctx context.Context) error {
+			for _, p := range s.provisioners {
+				if _, err := p.isSharedFilesystem(); err != nil {
+					return fmt.Errorf("%v: %v", p.provisionerName, err)
+				}
+			}
+			return nil
+		}},
+		{name: "apiserver", check: func(ctx context.Context) error {
+			return s.provisioners[0].kubeClient.Discovery().RESTClient().Get().AbsPath("/healthz").Timeout(5 * time.Second).Do(ctx).Error()
+		}},
+		{name: "leadership", check: func(ctx context.Context) error {
+			if s.leaderElect && atomic.LoadInt32(&s.leading) == 0 {
+				return fmt.Errorf("not the leader")
+			}
+			return nil
+		}},
+	}
+}
+
+func serveHealthChecks(checks func() []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		excluded := map[string]bool{}
+		for _, name := range r.URL.Query()["exclude"] {
+			excluded[name] = true
+		}
+		failed := false
+		var body strings.Builder
+		for _, c := range checks() {
+			if excluded[c.name] {
+				fmt.Fprintf(&body, "[+]%v excluded\n", c.name)
+				continue
+			}
+			if err := c.check(r.Context()); err != nil {
+				failed = true
+				fmt.Fprintf(&body, "[-]%v failed: %v\n", c.name, err)
+				continue
+			}
+			fmt.Fprintf(&body, "[+]%v ok\n", c.name)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, body.String())
+	}
+}
+
+// register adds the health endpoints to mux.
+func (s *healthServer) register(mux *http.ServeMux) {
+	mux.Handle("/healthz", serveHealthChecks(s.livenessChecks))
+	mux.Handle("/readyz", serveHealthChecks(s.readinessChecks))
+}
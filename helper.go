@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+const (
+	ActionTypeCopy = "copy"
+
+	LabelHelperAction = "local.path.provisioner/action"
+
+	// mountCheckSeconds is how often a pending helper pod is checked for
+	// host directories which cannot be mounted
+	mountCheckSeconds = 10
+
+	// copyScript copies the content of $1 into $2, falling back to a plain
+	// copy where reflinks are not available, e.g. with busybox cp
+	copyScript = `set -eu
+mkdir -p "$2"
+cp -a --reflink=auto "$1/." "$2/" 2>/dev/null || cp -a "$1/." "$2/"`
+)
+
+// hostMount is a host directory mounted at the same path in a helper pod.
+type hostMount struct {
+	Path     string
+	ReadOnly bool
+	// Create creates the directory when it is missing. Otherwise the helper
+	// pod does not start without it, so that a missing disk is not replaced
+	// by an empty directory on the root filesystem.
+	Create bool
+}
+
+// createMounts mounts dirs read-write, creating the missing ones.
+func createMounts(dirs ...string) []hostMount {
+	mounts := make([]hostMount, 0, len(dirs))
+	for _, dir := range dirs {
+		mounts = append(mounts, hostMount{Path: dir, Create: true})
+	}
+	return mounts
+}
+
+// existingMounts mounts dirs read-write, they must exist.
+func existingMounts(dirs ...string) []hostMount {
+	mounts := make([]hostMount, 0, len(dirs))
+	for _, dir := range dirs {
+		mounts = append(mounts, hostMount{Path: dir})
+	}
+	return mounts
+}
+
+// readOnlyMounts mounts dirs read-only, they must exist.
+func readOnlyMounts(dirs ...string) []hostMount {
+	mounts := make([]hostMount, 0, len(dirs))
+	for _, dir := range dirs {
+		mounts = append(mounts, hostMount{Path: dir, ReadOnly: true})
+	}
+	return mounts
+}
+
+// helperMountError is returned by runHelperPod when the helper pod cannot
+// start because host directories it mounts do not exist.
+type helperMountError struct {
+	pod  string
+	dirs []string
+}
+
+func (e *helperMountError) Error() string {
+	return fmt.Sprintf("helper pod %v cannot mount %v", e.pod, strings.Join(e.dirs, ", "))
+}
+
+// newNodeHelperPod builds a helper pod from the template which runs script on
+// node with every directory of mounts mounted from the host at the same path.
+// The positional parameters of the script are taken from args. An empty node
+// lets the scheduler pick one, which is only meaningful on a shared
+// filesystem.
+func (p *LocalPathProvisioner) newNodeHelperPod(action ActionType, node string, mounts []hostMount, script string, args []string) *v1.Pod {
+	helperPod := p.helperPod.DeepCopy()
+
+	var dirs []string
+	for _, m := range mounts {
+		dirs = append(dirs, m.Path)
+	}
+	helperPod.Name = helperPod.Name + "-" + string(action) + "-" + calculatorSha256(node+":"+strings.Join(dirs, ":")+":"+strings.Join(args, ":"))
+	if len(helperPod.Name) > HelperPodNameMaxLength {
+		helperPod.Name = helperPod.Name[:HelperPodNameMaxLength]
+	}
+	helperPod.Namespace = p.namespace
+	if helperPod.Labels == nil {
+		helperPod.Labels = map[string]string{}
+	}
+	helperPod.Labels[LabelHelperAction] = string(action)
+	if node != "" {
+		helperPod.Spec.NodeName = node
+	}
+
+	container := &helperPod.Spec.Containers[0]
+	for i, m := range mounts {
+		name := fmt.Sprintf("%s-%d", helperDataVolName, i)
+		hostPathType := v1.HostPathDirectory
+		if m.Create {
+			hostPathType = v1.HostPathDirectoryOrCreate
+		}
+		helperPod.Spec.Volumes = append(helperPod.Spec.Volumes, v1.Volume{
+			Name: name,
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: m.Path,
+					Type: &hostPathType,
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+			Name:      name,
+			MountPath: m.Path,
+			ReadOnly:  m.ReadOnly,
+		})
+	}
+
+	privileged := true
+	helperPod.Spec.ServiceAccountName = p.serviceAccountName
+	helperPod.Spec.RestartPolicy = v1.RestartPolicyNever
+	helperPod.Spec.Tolerations = append(helperPod.Spec.Tolerations, v1.Toleration{
+		Operator: v1.TolerationOpExists,
+	})
+	container.Command = []string{"/bin/sh", "-c", script, string(action)}
+	container.Args = args
+	container.SecurityContext = &v1.SecurityContext{
+		Privileged: &privileged,
+	}
+	return helperPod
+}
+
+// runHelperPod creates helperPod, waits for it to finish and returns its
+// output. The pod is removed afterwards, whether it succeeded or not.
+func (p *LocalPathProvisioner) runHelperPod(helperPod *v1.Pod) (output string, err error) {
+	pods := p.kubeClient.CoreV1().Pods(p.namespace)
+	release, err := p.helperSlots.acquire(p.helperCtx, helperPod.Spec.NodeName, false)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	defer p.operations.begin("helper pod %v", helperPod.Name)()
+
+	start := time.Now()
+	failure := helperFailureAPI
+	defer func() {
+		if err == nil {
+			failure = ""
+		}
+		p.observeHelperPod(ActionType(helperPod.Labels[LabelHelperAction]), helperPod.Spec.NodeName, start, failure)
+	}()
+
+	log := logrus.WithFields(logrus.Fields{
+		logFieldAction:    helperPod.Labels[LabelHelperAction],
+		logFieldHelperPod: helperPod.Name,
+	})
+	if helperPod.Spec.NodeName != "" {
+		log = log.WithField(logFieldNode, helperPod.Spec.NodeName)
+	}
+	ctx := p.helperCtx
+	existing, err := pods.Get(ctx, helperPod.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	if err == nil && existing.DeletionTimestamp == nil &&
+		(existing.Status.Phase == v1.PodPending || existing.Status.Phase == v1.PodRunning ||
+			existing.Annotations[AnnotationResumable] == "true") {
+		// the same work started by a previous leader or left running at
+		// shutdown, interrupting it could leave a half done copy behind
+		log.Infof("Waiting for the helper pod %v started before", helperPod.Name)
+	} else {
+		// a finished leftover pod with the same name would report a stale result
+		err = pods.Delete(ctx, helperPod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", err
+		}
+		for i := 0; i < p.config.CmdTimeoutSeconds; i++ {
+			if _, err = pods.Create(ctx, helperPod, metav1.CreateOptions{}); !apierrors.IsAlreadyExists(err) {
+				break
+			}
+			if !sleepOrDone(ctx, time.Second) {
+				break
+			}
+		}
+		if err != nil {
+			failure = helperFailureCreate
+			return "", err
+		}
+	}
+	abandoned := false
+	defer func() {
+		if abandoned {
+			return
+		}
+		if e := pods.Delete(context.TODO(), helperPod.Name, metav1.DeleteOptions{}); e != nil && !apierrors.IsNotFound(e) {
+			log.Errorf("unable to delete the helper pod: %v", e)
+		}
+	}()
+
+	phase := v1.PodPending
+	for i := 0; i < p.config.CmdTimeoutSeconds; i++ {
+		pod, err := pods.Get(ctx, helperPod.Name, metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			return "", err
+		}
+		if err == nil {
+			phase = pod.Status.Phase
+			if phase == v1.PodSucceeded || phase == v1.PodFailed {
+				break
+			}
+			if phase == v1.PodPending && i%mountCheckSeconds == mountCheckSeconds-1 {
+				// a missing host directory keeps the pod pending forever
+				if dirs := p.failedHelperMounts(pod); len(dirs) > 0 {
+					failure = helperFailureMount
+					return "", &helperMountError{pod: helperPod.Name, dirs: dirs}
+				}
+			}
+		}
+		if !sleepOrDone(ctx, time.Second) {
+			abandoned = true
+			failure = helperFailureShutdown
+			return "", p.abandonHelperPod(helperPod.Name)
+		}
+	}
+
+	switch phase {
+	case v1.PodSucceeded:
+	case v1.PodFailed:
+		failure = helperFailureFailed
+		logs, _ := pods.GetLogs(helperPod.Name, &v1.PodLogOptions{}).Do(ctx).Raw()
+		return "", fmt.Errorf("helper pod %v failed: %s", helperPod.Name, strings.TrimSpace(string(logs)))
+	default:
+		failure = helperFailureTimeout
+		return "", fmt.Errorf("helper pod %v timeout after %v seconds", helperPod.Name, p.config.CmdTimeoutSeconds)
+	}
+
+	logs, err := pods.GetLogs(helperPod.Name, &v1.PodLogOptions{}).Do(ctx).Raw()
+	if err != nil {
+		return "", err
+	}
+	return string(logs), nil
+}
+
+// failedHelperMounts returns the host directories of pod which the kubelet
+// reported as impossible to mount.
+func (p *LocalPathProvisioner) failedHelperMounts(pod *v1.Pod) []string {
+	events, err := p.kubeClient.CoreV1().Events(pod.Namespace).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("involvedObject.name", pod.Name),
+			fields.OneTermEqualSelector("involvedObject.uid", string(pod.UID)),
+			fields.OneTermEqualSelector("reason", "FailedMount"),
+		).String(),
+	})
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, vol := range pod.Spec.Volumes {
+		if vol.HostPath == nil {
+			continue
+		}
+		for _, event := range events.Items {
+			if strings.Contains(event.Message, fmt.Sprintf("%q", vol.Name)) {
+				dirs = append(dirs, vol.HostPath.Path)
+				break
+			}
+		}
+	}
+	return dirs
+}
+
+// copyVolumeData copies the content of the src directory into the dst
+// directory on node, using reflinks where the filesystem supports them.
+func (p *LocalPathProvisioner) copyVolumeData(node, src, dst string) error {
+	helperPod := p.newCopyHelperPod(node, src, dst)
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		return errors.Wrapf(err, "failed to copy %v to %v", src, dst)
+	}
+	return nil
+}
+
+func (p *LocalPathProvisioner) newCopyHelperPod(node, src, dst string) *v1.Pod {
+	// the source is only read, a missing one fails the copy instead of
+	// being created empty
+	mounts := append(createMounts(filepath.Dir(dst)), readOnlyMounts(src)...)
+	return p.newNodeHelperPod(ActionTypeCopy, node, mounts, copyScript, []string{src, dst})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+type leaderElectionOptions struct {
+	namespace     string
+	leaseName     string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// runWithLeaderElection runs run only while this replica holds the lease.
+// Everything acting on volumes, the provision
+// controller as well as the background loops, is started from run, so only
+// the leader creates helper pods. The process exits when the lease is lost,
+// helper pods still running are picked up by the next leader.
+func runWithLeaderElection(ctx context.Context, kubeClient *clientset.Clientset, o leaderElectionOptions, run func(ctx context.Context)) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "unable to get hostname for the leader election identity")
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock,
+		o.namespace,
+		o.leaseName,
+		kubeClient.CoreV1(),
+		kubeClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity: hostname + "_" + string(uuid.NewUUID()),
+		})
+	if err != nil {
+		return errors.Wrap(err, "unable to create the leader election lock")
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   o.leaseDuration,
+		RenewDeadline:   o.renewDeadline,
+		RetryPeriod:     o.retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logrus.Infof("Became the leader of %v", o.leaseName)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					logrus.Infof("Released the leadership of %v", o.leaseName)
+					return
+				}
+				logrus.Fatalf("Lost the leadership of %v", o.leaseName)
+			},
+			OnNewLeader: func(identity string) {
+				logrus.Infof("Current leader of %v is %v", o.leaseName, identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(ctx)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	// fields carried by the lines about a volume, so one claim can be
+	// followed through its lifecycle
+	logFieldNamespace = "namespace"
+	logFieldPVC       = "pvc"
+	logFieldPV        = "pv"
+	logFieldNode      = "node"
+	logFieldAction    = "action"
+	logFieldHelperPod = "helperPod"
+	logFieldSource    = "source"
+
+	actionConfigReload = "config-reload"
+)
+
+// setupLogging sets the format of the log lines and sends the lines of klog,
+// used by client-go and the provision controller, through logrus as well, so
+// every line of the process comes in the same format.
+func setupLogging(format string) error {
+	switch format {
+	case LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %v, must be %v or %v", format, LogFormatText, LogFormatJSON)
+	}
+
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	if err := flags.Set("logtostderr", "false"); err != nil {
+		return err
+	}
+	// klog writes every line to the outputs of its severity and of all lower
+	// severities, the info output alone sees each line once
+	if err := flags.Set("stderrthreshold", "FATAL"); err != nil {
+		return err
+	}
+	klog.SetOutputBySeverity("INFO", klogWriter{})
+	for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+	return nil
+}
+
+// klogWriter logs the lines of klog with logrus, at the level of the klog
+// severity and with the source file of the line as field.
+type klogWriter struct{}
+
+func (klogWriter) Write(data []byte) (int, error) {
+	line := strings.TrimSuffix(string(data), "\n")
+	severity := byte('I')
+	if len(line) > 0 {
+		severity = line[0]
+	}
+	source := ""
+	// klog lines start with "Lmmdd hh:mm:ss.uuuuuu threadid file:line] "
+	if i := strings.Index(line, "] "); i >= 0 {
+		if header := strings.Fields(line[:i]); len(header) > 0 {
+			source = header[len(header)-1]
+		}
+		line = line[i+2:]
+	}
+
+	entry := logrus.WithField(logFieldSource, source)
+	switch severity {
+	case 'W':
+		entry.Warn(line)
+	case 'E', 'F':
+		// klog exits by itself after a fatal line
+		entry.Error(line)
+	default:
+		entry.Info(line)
+	}
+	return len(data), nil
+}
+
+// volumeLog returns the logger for the lines about volume pv of the claim
+// namespace/pvc on node, empty values are left out.
+func volumeLog(namespace, pvc, pv, node string) *logrus.Entry {
+	fields := logrus.Fields{}
+	for key, value := range map[string]string{
+		logFieldNamespace: namespace,
+		logFieldPVC:       pvc,
+		logFieldPV:        pv,
+		logFieldNode:      node,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return logrus.WithFields(fields)
+}
+
+// pvLog returns the logger for the lines about pv on node.
+func pvLog(pv *v1.PersistentVolume, node string) *logrus.Entry {
+	namespace, claim := pvClaim(pv)
+	return volumeLog(namespace, claim, pv.Name, node)
+}
+
+// pvClaim returns the namespace and name of the claim pv is bound to, empty
+// when it is not bound.
+func pvClaim(pv *v1.PersistentVolume) (namespace, name string) {
+	if pv.Spec.ClaimRef == nil {
+		return "", ""
+	}
+	return pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+}
@@ -3,16 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -48,6 +55,46 @@ var (
 	DefaultProvisioningRetryCount = pvController.DefaultFailedProvisionThreshold
 	FlagDeletionRetryCount        = "deletion-retry-count"
 	DefaultDeletionRetryCount     = pvController.DefaultFailedDeleteThreshold
+	FlagMetricsAddress            = "metrics-address"
+	DefaultMetricsAddress         = ""
+	FlagHealthAddress             = "health-address"
+	DefaultHealthAddress          = ""
+	FlagUsageReportInterval       = "usage-report-interval"
+	DefaultUsageReportInterval    = time.Duration(0)
+	FlagEnableSnapshots           = "enable-snapshots"
+	FlagHealthCheckInterval       = "health-check-interval"
+	DefaultHealthCheckInterval    = time.Duration(0)
+	FlagNode                      = "node"
+	FlagPath                      = "path"
+	FlagPVC                       = "pvc"
+	FlagStorageClass              = "storage-class"
+	FlagCapacity                  = "capacity"
+	FlagVolumeType                = "volume-type"
+	FlagFormat                    = "format"
+	FlagReport                    = "report"
+	FlagConfirm                   = "confirm"
+	FlagReconcileOnStartup        = "reconcile-on-startup"
+	FlagGracePeriod               = "grace-period"
+	FlagApply                     = "apply"
+	FlagLeaderElect               = "leader-elect"
+	FlagLeaderElectNamespace      = "leader-elect-namespace"
+	FlagLeaderElectLeaseDuration  = "leader-elect-lease-duration"
+	FlagLeaderElectRenewDeadline  = "leader-elect-renew-deadline"
+	FlagLeaderElectRetryPeriod    = "leader-elect-retry-period"
+	FlagLeaderElectLeaseName      = "leader-elect-lease-name"
+	FlagShutdownGracePeriod       = "shutdown-grace-period"
+	DefaultShutdownGracePeriod    = 25 * time.Second
+	FlagWebhookAddress            = "webhook-address"
+	FlagWebhookCertFile           = "webhook-cert-file"
+	FlagWebhookKeyFile            = "webhook-key-file"
+	FlagPVCFile                   = "pvc-file"
+	FlagStorageClassFile          = "storage-class-file"
+	FlagPVName                    = "pv-name"
+	FlagCheck                     = "check"
+	FlagTargetNode                = "target-node"
+	FlagUndo                      = "undo"
+	FlagDrainInterval             = "drain-interval"
+	DefaultDrainInterval          = time.Duration(0)
 )
 
 func cmdNotFound(c *cli.Context, command string) {
@@ -68,70 +115,152 @@ func RegisterShutdownChannel(cancelFn context.CancelFunc) {
 	}()
 }
 
+// provisionerFlags are the flags every command needs to build a provisioner.
+func provisionerFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  FlagConfigFile,
+			Usage: "Required. Provisioner configuration file.",
+			Value: "",
+		},
+		cli.StringSliceFlag{
+			Name:   FlagProvisionerName,
+			Usage:  "Provisioner name, " + DefaultProvisionerName + " by default. Repeat it to serve several names from one process, optionally with the settings of each: name:config=...,configmap-name=...,helper-image=...,helper-pod-file=...",
+			EnvVar: EnvProvisionerName,
+		},
+		cli.StringFlag{
+			Name:   FlagNamespace,
+			Usage:  "Required. The namespace that Provisioner is running in",
+			EnvVar: EnvNamespace,
+			Value:  DefaultNamespace,
+		},
+		cli.StringFlag{
+			Name:   FlagHelperImage,
+			Usage:  "Required. The helper image used for create/delete directories on the host",
+			EnvVar: EnvHelperImage,
+			Value:  DefaultHelperImage,
+		},
+		cli.StringFlag{
+			Name:  FlagKubeconfig,
+			Usage: "Paths to a kubeconfig. Only required when it is out-of-cluster.",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  FlagConfigMapName,
+			Usage: "Required. Specify configmap name.",
+			Value: DefaultConfigMapName,
+		},
+		cli.StringFlag{
+			Name:   FlagServiceAccountName,
+			Usage:  "Required. The ServiceAccountName for deployment",
+			EnvVar: EnvServiceAccountName,
+			Value:  DefaultServiceAccount,
+		},
+		cli.StringFlag{
+			Name:  FlagHelperPodFile,
+			Usage: "Paths to the Helper pod yaml file",
+			Value: "",
+		},
+	}
+}
+
 func StartCmd() cli.Command {
 	return cli.Command{
 		Name: "start",
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:  FlagConfigFile,
-				Usage: "Required. Provisioner configuration file.",
-				Value: "",
+		Flags: append(provisionerFlags(),
+			cli.IntFlag{
+				Name:  FlagWorkerThreads,
+				Usage: "Number of provisioner worker threads.",
+				Value: DefaultWorkerThreads,
 			},
-			cli.StringFlag{
-				Name:   FlagProvisionerName,
-				Usage:  "Required. Specify Provisioner name.",
-				EnvVar: EnvProvisionerName,
-				Value:  DefaultProvisionerName,
+			cli.IntFlag{
+				Name:  FlagProvisioningRetryCount,
+				Usage: "Number of retries of failed volume provisioning. 0 means retry indefinitely.",
+				Value: DefaultProvisioningRetryCount,
+			},
+			cli.IntFlag{
+				Name:  FlagDeletionRetryCount,
+				Usage: "Number of retries of failed volume deletion. 0 means retry indefinitely.",
+				Value: DefaultDeletionRetryCount,
 			},
 			cli.StringFlag{
-				Name:   FlagNamespace,
-				Usage:  "Required. The namespace that Provisioner is running in",
-				EnvVar: EnvNamespace,
-				Value:  DefaultNamespace,
+				Name:  FlagMetricsAddress,
+				Usage: "The address (host:port) to serve Prometheus metrics on. Empty disables the metrics server.",
+				Value: DefaultMetricsAddress,
 			},
 			cli.StringFlag{
-				Name:   FlagHelperImage,
-				Usage:  "Required. The helper image used for create/delete directories on the host",
-				EnvVar: EnvHelperImage,
-				Value:  DefaultHelperImage,
+				Name:  FlagHealthAddress,
+				Usage: "The address (host:port) to serve /healthz and /readyz on. Empty disables the health endpoints.",
+				Value: DefaultHealthAddress,
+			},
+			cli.DurationFlag{
+				Name:  FlagUsageReportInterval,
+				Usage: "Interval between volume usage measurements. 0 disables usage reporting.",
+				Value: DefaultUsageReportInterval,
+			},
+			cli.DurationFlag{
+				Name:  FlagHealthCheckInterval,
+				Usage: "Interval between volume health checks. 0 disables health checking.",
+				Value: DefaultHealthCheckInterval,
+			},
+			cli.BoolFlag{
+				Name:  FlagLeaderElect,
+				Usage: "Elect a leader among the replicas, only the leader provisions volumes. Required with more than one replica.",
 			},
 			cli.StringFlag{
-				Name:  FlagKubeconfig,
-				Usage: "Paths to a kubeconfig. Only required when it is out-of-cluster.",
-				Value: "",
+				Name:  FlagLeaderElectNamespace,
+				Usage: "Namespace of the leader election lease. Defaults to the namespace of the provisioner.",
 			},
 			cli.StringFlag{
-				Name:  FlagConfigMapName,
-				Usage: "Required. Specify configmap name.",
-				Value: DefaultConfigMapName,
+				Name:  FlagLeaderElectLeaseName,
+				Usage: "Name of the leader election lease, shared by all the provisioner names of the process. Defaults to the provisioner name, required with more than one.",
+			},
+			cli.DurationFlag{
+				Name:  FlagLeaderElectLeaseDuration,
+				Usage: "Duration non-leader replicas wait before trying to take over the lease of a leader which stopped renewing it.",
+				Value: pvController.DefaultLeaseDuration,
+			},
+			cli.DurationFlag{
+				Name:  FlagLeaderElectRenewDeadline,
+				Usage: "Duration the leader retries renewing its lease before giving up the leadership.",
+				Value: pvController.DefaultRenewDeadline,
+			},
+			cli.DurationFlag{
+				Name:  FlagLeaderElectRetryPeriod,
+				Usage: "Duration between two attempts to acquire or renew the lease.",
+				Value: pvController.DefaultRetryPeriod,
+			},
+			cli.DurationFlag{
+				Name:  FlagDrainInterval,
+				Usage: "Interval between migrations of the volumes of the nodes annotated with " + AnnotationDraining + "=<target node>. 0 disables them, new volumes are kept off annotated nodes regardless.",
+				Value: DefaultDrainInterval,
+			},
+			cli.DurationFlag{
+				Name:  FlagShutdownGracePeriod,
+				Usage: "Duration to wait for the helper pods in flight on shutdown. Helper pods still running afterwards are left to the next instance. Keep it below the terminationGracePeriodSeconds of the pod.",
+				Value: DefaultShutdownGracePeriod,
 			},
 			cli.StringFlag{
-				Name:   FlagServiceAccountName,
-				Usage:  "Required. The ServiceAccountName for deployment",
-				EnvVar: EnvServiceAccountName,
-				Value:  DefaultServiceAccount,
+				Name:  FlagWebhookAddress,
+				Usage: "Address to serve the validating admission webhook on over TLS, e.g. :9443, at " + webhookPath + ". Claims of our storage classes which would fail to provision are rejected on creation. Disabled when empty.",
 			},
 			cli.StringFlag{
-				Name:  FlagHelperPodFile,
-				Usage: "Paths to the Helper pod yaml file",
-				Value: "",
+				Name:  FlagWebhookCertFile,
+				Usage: "Certificate served by the admission webhook, reloaded when it changes.",
 			},
-			cli.IntFlag{
-				Name:  FlagWorkerThreads,
-				Usage: "Number of provisioner worker threads.",
-				Value: DefaultWorkerThreads,
+			cli.StringFlag{
+				Name:  FlagWebhookKeyFile,
+				Usage: "Private key of the certificate served by the admission webhook.",
 			},
-			cli.IntFlag{
-				Name:  FlagProvisioningRetryCount,
-				Usage: "Number of retries of failed volume provisioning. 0 means retry indefinitely.",
-				Value: DefaultProvisioningRetryCount,
+			cli.BoolTFlag{
+				Name:  FlagReconcileOnStartup,
+				Usage: "Report PVs whose directory is missing and directories without PV on startup.",
 			},
-			cli.IntFlag{
-				Name:  FlagDeletionRetryCount,
-				Usage: "Number of retries of failed volume deletion. 0 means retry indefinitely.",
-				Value: DefaultDeletionRetryCount,
+			cli.BoolFlag{
+				Name:  FlagEnableSnapshots,
+				Usage: "Take LocalVolumeSnapshots of provisioned volumes. Requires the LocalVolumeSnapshot CRD.",
 			},
-		},
+		),
 		Action: func(c *cli.Context) {
 			if err := startDaemon(c); err != nil {
 				logrus.Fatalf("Error starting daemon: %v", err)
@@ -182,65 +311,120 @@ func findConfigFileFromConfigMap(kubeClient clientset.Interface, namespace, conf
 	return value, nil
 }
 
-func startDaemon(c *cli.Context) error {
-	ctx, cancelFn := context.WithCancel(context.TODO())
-	RegisterShutdownChannel(cancelFn)
+// newProvisionerFromFlags builds a provisioner out of the flags shared by all
+// commands, see provisionerFlags. The commands other than start work on a
+// single provisioner name.
+func newProvisionerFromFlags(ctx context.Context, c *cli.Context) (*LocalPathProvisioner, error) {
+	provisioners, err := newProvisionersFromFlags(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(provisioners) != 1 {
+		return nil, fmt.Errorf("flag %v is given %v times, this command works on a single provisioner name", FlagProvisionerName, len(provisioners))
+	}
+	return provisioners[0], nil
+}
 
+// newProvisionersFromFlags builds a provisioner for every provisioner name
+// given, each with its own profile, see parseProvisionerProfile.
+func newProvisionersFromFlags(ctx context.Context, c *cli.Context) ([]*LocalPathProvisioner, error) {
 	config, err := loadConfig(c.String(FlagKubeconfig))
 	if err != nil {
-		return errors.Wrap(err, "unable to get client config")
+		return nil, errors.Wrap(err, "unable to get client config")
 	}
 
 	kubeClient, err := clientset.NewForConfig(config)
 	if err != nil {
-		return errors.Wrap(err, "unable to get k8s client")
+		return nil, errors.Wrap(err, "unable to get k8s client")
 	}
 
-	provisionerName := c.String(FlagProvisionerName)
-	if provisionerName == "" {
-		return fmt.Errorf("invalid empty flag %v", FlagProvisionerName)
-	}
 	namespace := c.String(FlagNamespace)
 	if namespace == "" {
-		return fmt.Errorf("invalid empty flag %v", FlagNamespace)
+		return nil, fmt.Errorf("invalid empty flag %v", FlagNamespace)
+	}
+	serviceAccountName := c.String(FlagServiceAccountName)
+	if serviceAccountName == "" {
+		return nil, fmt.Errorf("invalid empty flag %v", FlagServiceAccountName)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get k8s dynamic client")
+	}
+
+	defaults := provisionerProfile{
+		configFile:    c.String(FlagConfigFile),
+		configMapName: c.String(FlagConfigMapName),
+		helperImage:   c.String(FlagHelperImage),
+		helperPodFile: c.String(FlagHelperPodFile),
 	}
-	configMapName := c.String(FlagConfigMapName)
+	names := c.StringSlice(FlagProvisionerName)
+	if len(names) == 0 {
+		// a default value of a slice flag would be kept next to the given ones
+		names = []string{DefaultProvisionerName}
+	}
+	var provisioners []*LocalPathProvisioner
+	seen := map[string]bool{}
+	for _, name := range names {
+		profile, err := parseProvisionerProfile(name, defaults)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid flag %v", FlagProvisionerName)
+		}
+		if seen[profile.name] {
+			return nil, fmt.Errorf("duplicate provisioner name %v in flag %v", profile.name, FlagProvisionerName)
+		}
+		seen[profile.name] = true
+		p, err := newProvisionerFromProfile(ctx, kubeClient, dynamicClient, namespace, serviceAccountName, profile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set up provisioner %v", profile.name)
+		}
+		provisioners = append(provisioners, p)
+	}
+	shareHelperLimiter(provisioners)
+	return provisioners, nil
+}
+
+func newProvisionerFromProfile(ctx context.Context, kubeClient *clientset.Clientset, dynamicClient dynamic.Interface, namespace, serviceAccountName string, profile provisionerProfile) (*LocalPathProvisioner, error) {
+	var err error
+	configMapName := profile.configMapName
 	if configMapName == "" {
-		return fmt.Errorf("invalid empty flag %v", FlagConfigMapName)
+		return nil, fmt.Errorf("invalid empty flag %v", FlagConfigMapName)
 	}
-	configFile := c.String(FlagConfigFile)
+	configFile := profile.configFile
 	if configFile == "" {
 		configFile, err = findConfigFileFromConfigMap(kubeClient, namespace, configMapName, DefaultConfigFileKey)
 		if err != nil {
-			return fmt.Errorf("invalid empty flag %v and it also does not exist at ConfigMap %v/%v with err: %v", FlagConfigFile, namespace, configMapName, err)
+			return nil, fmt.Errorf("invalid empty flag %v and it also does not exist at ConfigMap %v/%v with err: %v", FlagConfigFile, namespace, configMapName, err)
 		}
 	}
-	helperImage := c.String(FlagHelperImage)
+	helperImage := profile.helperImage
 	if helperImage == "" {
-		return fmt.Errorf("invalid empty flag %v", FlagHelperImage)
-	}
-
-	serviceAccountName := c.String(FlagServiceAccountName)
-	if serviceAccountName == "" {
-		return fmt.Errorf("invalid empty flag %v", FlagServiceAccountName)
+		return nil, fmt.Errorf("invalid empty flag %v", FlagHelperImage)
 	}
 
 	// if helper pod file is not specified, then find the helper pod by configmap with key = helperPod.yaml
 	// if helper pod file is specified with flag FlagHelperPodFile, then load the file
-	helperPodFile := c.String(FlagHelperPodFile)
+	helperPodFile := profile.helperPodFile
 	helperPodYaml := ""
 	if helperPodFile == "" {
 		helperPodYaml, err = findConfigFileFromConfigMap(kubeClient, namespace, configMapName, DefaultHelperPodFile)
 		if err != nil {
-			return fmt.Errorf("invalid empty flag %v and it also does not exist at ConfigMap %v/%v with err: %v", FlagHelperPodFile, namespace, configMapName, err)
+			return nil, fmt.Errorf("invalid empty flag %v and it also does not exist at ConfigMap %v/%v with err: %v", FlagHelperPodFile, namespace, configMapName, err)
 		}
 	} else {
 		helperPodYaml, err = loadFile(helperPodFile)
 		if err != nil {
-			return fmt.Errorf("could not open file %v with err: %v", helperPodFile, err)
+			return nil, fmt.Errorf("could not open file %v with err: %v", helperPodFile, err)
 		}
 	}
 
+	return NewProvisioner(ctx, kubeClient, dynamicClient, profile.name, configFile, namespace, helperImage, configMapName, serviceAccountName, helperPodYaml)
+}
+
+func startDaemon(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	RegisterShutdownChannel(cancelFn)
+
 	provisioningRetryCount := c.Int(FlagProvisioningRetryCount)
 	if provisioningRetryCount < 0 {
 		return fmt.Errorf("invalid negative integer flag %v", FlagProvisioningRetryCount)
@@ -256,22 +440,170 @@ func startDaemon(c *cli.Context) error {
 		return fmt.Errorf("invalid zero or negative integer flag %v", FlagWorkerThreads)
 	}
 
-	provisioner, err := NewProvisioner(ctx, kubeClient, configFile, namespace, helperImage, configMapName, serviceAccountName, helperPodYaml)
-	if err != nil {
-		return err
+	usageReportInterval := c.Duration(FlagUsageReportInterval)
+	if usageReportInterval < 0 {
+		return fmt.Errorf("invalid negative duration flag %v", FlagUsageReportInterval)
+	}
+
+	healthCheckInterval := c.Duration(FlagHealthCheckInterval)
+	if healthCheckInterval < 0 {
+		return fmt.Errorf("invalid negative duration flag %v", FlagHealthCheckInterval)
+	}
+
+	drainInterval := c.Duration(FlagDrainInterval)
+	if drainInterval < 0 {
+		return fmt.Errorf("invalid negative duration flag %v", FlagDrainInterval)
+	}
+
+	shutdownGracePeriod := c.Duration(FlagShutdownGracePeriod)
+	if shutdownGracePeriod < 0 {
+		return fmt.Errorf("invalid negative duration flag %v", FlagShutdownGracePeriod)
 	}
-	pc := pvController.NewProvisionController(
-		kubeClient,
-		provisionerName,
-		provisioner,
+
+	controllerOptions := []func(*pvController.ProvisionController) error{
+		// the election of the library only gates its own controller, one per
+		// provisioner name, while runWithLeaderElection gates the whole
+		// process including the background loops
 		pvController.LeaderElection(false),
 		pvController.FailedProvisionThreshold(provisioningRetryCount),
 		pvController.FailedDeleteThreshold(deletionRetryCount),
 		pvController.Threadiness(workerThreads),
-	)
-	logrus.Debug("Provisioner started")
-	pc.Run(ctx)
-	logrus.Debug("Provisioner stopped")
+	}
+	metricsAddress := c.String(FlagMetricsAddress)
+	if metricsAddress != "" {
+		_, port, err := net.SplitHostPort(metricsAddress)
+		if err != nil {
+			return fmt.Errorf("invalid flag %v: %v", FlagMetricsAddress, err)
+		}
+		if metricsPort, err := strconv.ParseInt(port, 10, 32); err != nil || metricsPort <= 0 {
+			return fmt.Errorf("invalid port in flag %v: %v", FlagMetricsAddress, port)
+		}
+	}
+
+	leaderElect := c.Bool(FlagLeaderElect)
+	electionOptions := leaderElectionOptions{
+		namespace:     c.String(FlagLeaderElectNamespace),
+		leaseName:     c.String(FlagLeaderElectLeaseName),
+		leaseDuration: c.Duration(FlagLeaderElectLeaseDuration),
+		renewDeadline: c.Duration(FlagLeaderElectRenewDeadline),
+		retryPeriod:   c.Duration(FlagLeaderElectRetryPeriod),
+	}
+	if leaderElect {
+		if electionOptions.namespace == "" {
+			electionOptions.namespace = c.String(FlagNamespace)
+		}
+		if electionOptions.leaseDuration <= electionOptions.renewDeadline {
+			return fmt.Errorf("flag %v must be greater than flag %v", FlagLeaderElectLeaseDuration, FlagLeaderElectRenewDeadline)
+		}
+		if electionOptions.retryPeriod <= 0 || electionOptions.renewDeadline <= electionOptions.retryPeriod {
+			return fmt.Errorf("flag %v must be greater than flag %v, which must be positive", FlagLeaderElectRenewDeadline, FlagLeaderElectRetryPeriod)
+		}
+	}
+
+	provisioners, err := newProvisionersFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	if leaderElect && electionOptions.leaseName == "" {
+		if len(provisioners) > 1 {
+			return fmt.Errorf("flag %v is required with more than one provisioner name", FlagLeaderElectLeaseName)
+		}
+		electionOptions.leaseName = strings.Replace(provisioners[0].provisionerName, "/", "-", -1)
+	}
+	healthAddress := c.String(FlagHealthAddress)
+	if healthAddress != "" {
+		if _, _, err := net.SplitHostPort(healthAddress); err != nil {
+			return fmt.Errorf("invalid flag %v: %v", FlagHealthAddress, err)
+		}
+	}
+	if webhookAddress := c.String(FlagWebhookAddress); webhookAddress != "" {
+		if _, _, err := net.SplitHostPort(webhookAddress); err != nil {
+			return fmt.Errorf("invalid flag %v: %v", FlagWebhookAddress, err)
+		}
+		if c.String(FlagWebhookCertFile) == "" || c.String(FlagWebhookKeyFile) == "" {
+			return fmt.Errorf("flag %v requires flags %v and %v", FlagWebhookAddress, FlagWebhookCertFile, FlagWebhookKeyFile)
+		}
+		// every replica answers, the API server calls any of them
+		if err := serveWebhook(ctx, webhookAddress, c.String(FlagWebhookCertFile), c.String(FlagWebhookKeyFile), provisioners); err != nil {
+			return err
+		}
+	}
+
+	// served by every replica, not only by the leader
+	health := newHealthServer(provisioners, leaderElect)
+	if metricsAddress != "" {
+		mux := newMetricsHandler(ctx, provisioners)
+		if healthAddress == metricsAddress {
+			health.register(mux)
+		}
+		serveHTTP(ctx, metricsAddress, mux)
+	}
+	if healthAddress != "" && healthAddress != metricsAddress {
+		mux := http.NewServeMux()
+		health.register(mux)
+		serveHTTP(ctx, healthAddress, mux)
+	}
+	// one provision controller per provisioner name, the AdditionalProvisionerNames
+	// of a single controller would not delete the volumes of the additional names
+	run := func(ctx context.Context) {
+		health.setLeading()
+		var wg sync.WaitGroup
+		for _, provisioner := range provisioners {
+			if usageReportInterval > 0 {
+				provisioner.watchAndReportUsage(usageReportInterval)
+			}
+			if healthCheckInterval > 0 {
+				provisioner.watchAndCheckHealth(healthCheckInterval)
+			}
+			if c.Bool(FlagEnableSnapshots) {
+				provisioner.watchAndSyncSnapshots()
+			}
+			provisioner.watchAndSweepTrash()
+			provisioner.watchAndCheckDeletedNodes()
+			if drainInterval > 0 {
+				provisioner.watchAndDrainNodes(drainInterval)
+			}
+			if c.BoolT(FlagReconcileOnStartup) {
+				go func(provisioner *LocalPathProvisioner) {
+					report, err := provisioner.reconcile()
+					if err != nil {
+						logrus.Errorf("failed to reconcile volumes of %v: %v", provisioner.provisionerName, err)
+						return
+					}
+					logReconcileReport(report)
+				}(provisioner)
+			}
+			pc := pvController.NewProvisionController(
+				provisioner.kubeClient,
+				provisioner.provisionerName,
+				provisioner,
+				controllerOptions...,
+			)
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				logrus.Debugf("Provisioner %v started", name)
+				pc.Run(ctx)
+				logrus.Debugf("Provisioner %v stopped", name)
+			}(provisioner.provisionerName)
+		}
+		wg.Wait()
+	}
+	if leaderElect {
+		// the lease is held until the helper pods in flight are drained, so
+		// the next leader does not start working on the same volumes
+		leaseCtx, releaseLease := context.WithCancel(context.Background())
+		go func() {
+			<-ctx.Done()
+			drainAll(provisioners, shutdownGracePeriod)
+			releaseLease()
+		}()
+		return runWithLeaderElection(leaseCtx, provisioners[0].kubeClient, electionOptions, func(context.Context) {
+			run(ctx)
+		})
+	}
+	run(ctx)
+	drainAll(provisioners, shutdownGracePeriod)
 	return nil
 }
 
@@ -286,7 +618,7 @@ func main() {
 		if c.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
-		return nil
+		return setupLogging(c.GlobalString("log-format"))
 	}
 
 	a.Flags = []cli.Flag{
@@ -295,9 +627,22 @@ func main() {
 			Usage:  "enable debug logging level",
 			EnvVar: "RANCHER_DEBUG",
 		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "format of the log lines, text or json",
+			Value:  LogFormatText,
+			EnvVar: "LOG_FORMAT",
+		},
 	}
 	a.Commands = []cli.Command{
 		StartCmd(),
+		TrashCmd(),
+		AdoptCmd(),
+		PlanCmd(),
+		VolumesCmd(),
+		DrainNodeCmd(),
+		ReconcileCmd(),
+		GCCmd(),
 	}
 	a.CommandNotFound = cmdNotFound
 	a.OnUsageError = onUsageError
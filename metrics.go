@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	controllerMetrics "sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller/metrics"
+)
+
+const metricsNamespace = "local_path_provisioner"
+
+const (
+	helperFailureCreate  = "create"
+	helperFailureFailed  = "failed"
+	helperFailureTimeout = "timeout"
+	helperFailureAPI     = "api"
+	helperFailureMount   = "mount"
+
+	// left running for the next instance at shutdown
+	helperFailureShutdown = "shutdown"
+)
+
+var (
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_used_bytes",
+		Help:      "Bytes used by the directory of a provisioned volume.",
+	}, []string{"provisioner", "namespace", "persistentvolumeclaim", "persistentvolume", "node"})
+
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_capacity_bytes",
+		Help:      "Requested capacity of a provisioned volume in bytes.",
+	}, []string{"provisioner", "namespace", "persistentvolumeclaim", "persistentvolume", "node"})
+
+	volumeAbnormal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_abnormal",
+		Help:      "Whether the directory of a provisioned volume failed its last health check.",
+	}, []string{"provisioner", "namespace", "persistentvolumeclaim", "persistentvolume", "node"})
+
+	helperPodDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "helper_pod_duration_seconds",
+		Help:      "Time from the creation of a helper pod to its completion.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600, 1800},
+	}, []string{"provisioner", "action", "node"})
+
+	helperPodFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "helper_pod_failures_total",
+		Help:      "Helper pods which did not succeed, by reason: create, failed, timeout, api, mount or shutdown.",
+	}, []string{"provisioner", "action", "node", "reason"})
+
+	modelPullBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "model_pull_bytes_total",
+		Help:      "Bytes of models pulled into model cache volumes.",
+	}, []string{"node"})
+
+	modelPullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "model_pull_duration_seconds",
+		Help:      "Time taken to pull a model into a model cache volume.",
+		Buckets:   []float64{5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"node"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Attempts to apply a changed config, by result: success or failure.",
+	}, []string{"provisioner", "result"})
+
+	configLastReloadSuccessful = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last attempt to apply a changed config succeeded.",
+	}, []string{"provisioner"})
+
+	helperPodsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "helper_pods_queued",
+		Help:      "Helper pods waiting for a free slot under the helper concurrency limits.",
+	})
+
+	volumesPerPathDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "volumes"),
+		"Provisioned volumes by node and configured path.",
+		[]string{"provisioner", "node", "path"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(
+		volumeUsedBytes,
+		volumeCapacityBytes,
+		volumeAbnormal,
+		helperPodDuration,
+		helperPodFailures,
+		modelPullBytes,
+		modelPullDuration,
+		configReloads,
+		configLastReloadSuccessful,
+		helperPodsQueued,
+	)
+}
+
+// registerControllerMetrics registers the metrics of the provision controller
+// library, which only registers them itself when it serves them.
+func registerControllerMetrics() {
+	prometheus.MustRegister(
+		controllerMetrics.M.PersistentVolumeClaimProvisionTotal,
+		controllerMetrics.M.PersistentVolumeClaimProvisionFailedTotal,
+		controllerMetrics.M.PersistentVolumeClaimProvisionDurationSeconds,
+		controllerMetrics.M.PersistentVolumeDeleteTotal,
+		controllerMetrics.M.PersistentVolumeDeleteFailedTotal,
+		controllerMetrics.M.PersistentVolumeDeleteDurationSeconds,
+	)
+}
+
+// observeHelperPod records a helper pod which ran for action on node since
+// start. An empty failure means it succeeded.
+func (p *LocalPathProvisioner) observeHelperPod(action ActionType, node string, start time.Time, failure string) {
+	if failure != "" {
+		helperPodFailures.WithLabelValues(p.provisionerName, string(action), node, failure).Inc()
+		return
+	}
+	helperPodDuration.WithLabelValues(p.provisionerName, string(action), node).Observe(time.Since(start).Seconds())
+}
+
+// gaugeSeries are the series of a gauge vector set by one provisioner name on
+// each round of a periodic check. The series it set on the previous round and
+// not on the current one are deleted, those of the other names are left alone.
+type gaugeSeries struct {
+	vec     *prometheus.GaugeVec
+	mutex   sync.Mutex
+	current map[string][]string
+	next    map[string][]string
+}
+
+func newGaugeSeries(vec *prometheus.GaugeVec) *gaugeSeries {
+	return &gaugeSeries{vec: vec, current: map[string][]string{}, next: map[string][]string{}}
+}
+
+// set sets the series of labelValues to value in the current round.
+func (s *gaugeSeries) set(value float64, labelValues ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.vec.WithLabelValues(labelValues...).Set(value)
+	s.next[strings.Join(labelValues, "\x00")] = labelValues
+}
+
+// flush ends the current round, deleting the series which were not set.
+func (s *gaugeSeries) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, labelValues := range s.current {
+		if _, ok := s.next[key]; !ok {
+			s.vec.DeleteLabelValues(labelValues...)
+		}
+	}
+	s.current, s.next = s.next, map[string][]string{}
+}
+
+// volumeCountCollector counts the provisioned volumes per configured path
+// of each provisioner name when scraped. The PVs come from an informer, so
+// scrapes do not list them from the API server.
+type volumeCountCollector struct {
+	provisioners []*LocalPathProvisioner
+	volumes      corelisters.PersistentVolumeLister
+	synced       cache.InformerSynced
+}
+
+func (c *volumeCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesPerPathDesc
+}
+
+func (c *volumeCountCollector) Collect(ch chan<- prometheus.Metric) {
+	if !c.synced() {
+		// an empty count would read as all volumes gone
+		return
+	}
+	pvs, err := c.volumes.List(labels.Everything())
+	if err != nil {
+		logrus.Errorf("failed to count volumes: %v", err)
+		return
+	}
+	type nodePath struct{ node, path string }
+	for _, p := range c.provisioners {
+		counts := map[nodePath]int{}
+		for _, pv := range pvs {
+			if pv.Annotations[annProvisionedBy] != p.provisionerName {
+				continue
+			}
+			path, node, err := p.getPathAndNodeForPV(pv)
+			if err != nil {
+				continue
+			}
+			counts[nodePath{node, p.getBasePathForVolume(node, filepath.Clean(path))}]++
+		}
+		for k, count := range counts {
+			ch <- prometheus.MustNewConstMetric(volumesPerPathDesc, prometheus.GaugeValue, float64(count), p.provisionerName, k.node, k.path)
+		}
+	}
+}
+
+// serveHTTP serves handler on address until ctx is done.
+func serveHTTP(ctx context.Context, address string, handler http.Handler) {
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		logrus.Infof("Serving HTTP on %v", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Fatalf("failed to serve HTTP on %v: %v", address, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+}
+
+// newMetricsHandler returns the handler serving the metrics of p and of the
+// provision controller on /metrics. The PV informer of the volume counts runs
+// until ctx is done.
+func newMetricsHandler(ctx context.Context, provisioners []*LocalPathProvisioner) *http.ServeMux {
+	registerControllerMetrics()
+	factory := informers.NewSharedInformerFactory(provisioners[0].kubeClient, 0)
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	collector := &volumeCountCollector{
+		provisioners: provisioners,
+		volumes:      pvInformer.Lister(),
+		synced:       pvInformer.Informer().HasSynced,
+	}
+	factory.Start(ctx.Done())
+	prometheus.MustRegister(collector)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
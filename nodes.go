@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// AnnotationNodeDeleted marks a PV whose node was removed from the
+	// cluster, its value is the name of that node
+	AnnotationNodeDeleted = "local.path.provisioner/node-deleted"
+
+	// ClaimConditionNodeDeleted is set on the claims of the volumes of a
+	// node removed from the cluster
+	ClaimConditionNodeDeleted v1.PersistentVolumeClaimConditionType = "LocalPathNodeDeleted"
+
+	// DeletedNodePolicyFail fails the deletion of a volume whose node is gone
+	// right away, leaving the PV to the administrator
+	DeletedNodePolicyFail = "fail"
+	// DeletedNodePolicyRelease deletes the PV of a volume whose node is gone
+	// without running the teardown script
+	DeletedNodePolicyRelease = "release"
+)
+
+var (
+	NodeCheckInterval = 1 * time.Minute
+)
+
+func canonicalizeDeletedNodePolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return DeletedNodePolicyFail, nil
+	case DeletedNodePolicyFail, DeletedNodePolicyRelease:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid deletedNodePolicy %q, must be %v or %v", policy, DeletedNodePolicyFail, DeletedNodePolicyRelease)
+}
+
+// nodeExists tells whether the node of a volume is part of the cluster. node
+// is the hostname label value of the node affinity of the volume, which is
+// usually but not necessarily the name of the node. Nodes without the label
+// are matched by name, as newPersistentVolume falls back to it.
+func (p *LocalPathProvisioner) nodeExists(node string) (bool, error) {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.Set{KeyNode: node}.String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(nodes.Items) > 0 {
+		return true, nil
+	}
+	_, err = p.kubeClient.CoreV1().Nodes().Get(context.TODO(), node, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p *LocalPathProvisioner) watchAndCheckDeletedNodes() {
+	go func() {
+		ticker := time.NewTicker(NodeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.checkDeletedNodes(); err != nil {
+					logrus.Errorf("failed to check for deleted nodes: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop checking for deleted nodes")
+				return
+			}
+		}
+	}()
+}
+
+// checkDeletedNodes marks the volumes whose node was removed from the
+// cluster, and unmarks them if a node of the same name joins again.
+func (p *LocalPathProvisioner) checkDeletedNodes() error {
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil || sharedFS {
+		return err
+	}
+	nodeList, err := p.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	nodes := map[string]struct{}{}
+	for _, node := range nodeList.Items {
+		// like nodeExists, the node affinity of a volume holds the hostname
+		// label of its node, or its name for nodes without the label
+		nodes[node.Name] = struct{}{}
+		if hostname, ok := node.Labels[KeyNode]; ok {
+			nodes[hostname] = struct{}{}
+		}
+	}
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return err
+	}
+	for _, pv := range pvs {
+		_, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil || node == "" {
+			continue
+		}
+		_, exists := nodes[node]
+		marked := pv.Annotations[AnnotationNodeDeleted] != ""
+		if !exists && !marked {
+			p.markNodeDeleted(pv, node)
+		} else if exists && marked {
+			p.unmarkNodeDeleted(pv, node)
+		}
+	}
+	return nil
+}
+
+// markNodeDeleted records on pv and its claim that node is gone.
+func (p *LocalPathProvisioner) markNodeDeleted(pv *v1.PersistentVolume, node string) {
+	namespace, claim := pvClaim(pv)
+	msg := fmt.Sprintf("node %v of volume %v no longer exists, the data on it is unreachable", node, pv.Name)
+	volumeLog(namespace, claim, pv.Name, node).Warnf("Node %v of volume %v no longer exists", node, pv.Name)
+	p.annotateNodeDeleted(pv, node)
+	p.eventRecorder.Event(pv, v1.EventTypeWarning, "NodeDeleted", msg)
+	if pv.Spec.ClaimRef != nil {
+		p.eventRecorder.Event(pv.Spec.ClaimRef, v1.EventTypeWarning, "NodeDeleted", msg)
+		p.setNodeDeletedCondition(namespace, claim, v1.ConditionTrue, "NodeDeleted", msg)
+	}
+}
+
+// unmarkNodeDeleted clears the marks of markNodeDeleted once node is back.
+func (p *LocalPathProvisioner) unmarkNodeDeleted(pv *v1.PersistentVolume, node string) {
+	namespace, claim := pvClaim(pv)
+	msg := fmt.Sprintf("node %v of volume %v is part of the cluster again", node, pv.Name)
+	volumeLog(namespace, claim, pv.Name, node).Infof("Node %v of volume %v is back", node, pv.Name)
+	p.annotateNodeDeleted(pv, "")
+	p.eventRecorder.Event(pv, v1.EventTypeNormal, "NodeRestored", msg)
+	if pv.Spec.ClaimRef != nil {
+		p.eventRecorder.Event(pv.Spec.ClaimRef, v1.EventTypeNormal, "NodeRestored", msg)
+		p.setNodeDeletedCondition(namespace, claim, v1.ConditionFalse, "NodeRestored", msg)
+	}
+}
+
+// annotateNodeDeleted sets the node-deleted annotation of pv to node, or
+// removes it when node is empty.
+func (p *LocalPathProvisioner) annotateNodeDeleted(pv *v1.PersistentVolume, node string) {
+	var value interface{} = node
+	if node == "" {
+		value = nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]interface{}{AnnotationNodeDeleted: value}}})
+	if _, err := p.kubeClient.CoreV1().PersistentVolumes().Patch(context.TODO(), pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		logrus.Errorf("failed to annotate volume %v: %v", pv.Name, err)
+	}
+}
+
+func (p *LocalPathProvisioner) setNodeDeletedCondition(namespace, claim string, status v1.ConditionStatus, reason, msg string) {
+	// the conditions of a claim are merged by type
+	patch, _ := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.PersistentVolumeClaimCondition{{
+				Type:               ClaimConditionNodeDeleted,
+				Status:             status,
+				LastTransitionTime: metav1.Now(),
+				Reason:             reason,
+				Message:            msg,
+			}},
+		},
+	})
+	_, err := p.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Patch(context.TODO(), claim, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Errorf("failed to set condition %v of claim %v/%v: %v", ClaimConditionNodeDeleted, namespace, claim, err)
+	}
+}
+
+// deleteOnDeletedNode deletes the volume pv left on node, which is gone,
+// according to the deletedNodePolicy.
+func (p *LocalPathProvisioner) deleteOnDeletedNode(pv *v1.PersistentVolume, node, path string) error {
+	// the PV handed to Delete is not updated between retries
+	current, err := p.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), pv.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		pv = current
+	}
+	if pv.Annotations[AnnotationNodeDeleted] == "" {
+		p.markNodeDeleted(pv, node)
+	}
+	p.configMutex.RLock()
+	policy := p.config.DeletedNodePolicy
+	p.configMutex.RUnlock()
+
+	namespace, claim := pvClaim(pv)
+	if policy == DeletedNodePolicyRelease {
+		volumeLog(namespace, claim, pv.Name, node).WithField(logFieldAction, ActionTypeDelete).
+			Warnf("Releasing volume %v without tearing down %v:%v, node %v no longer exists", pv.Name, node, path, node)
+		return nil
+	}
+	return fmt.Errorf("node %v no longer exists, %v cannot be torn down. Delete the PV once the data is dealt with, or set deletedNodePolicy to %v",
+		node, path, DeletedNodePolicyRelease)
+}
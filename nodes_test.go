@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCanonicalizeDeletedNodePolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: DeletedNodePolicyFail},
+		{policy: DeletedNodePolicyFail, want: DeletedNodePolicyFail},
+		{policy: DeletedNodePolicyRelease, want: DeletedNodePolicyRelease},
+		{policy: "Release", wantErr: true},
+		{policy: "delete", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := canonicalizeDeletedNodePolicy(tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("canonicalizeDeletedNodePolicy(%q) error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("canonicalizeDeletedNodePolicy(%q) = %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
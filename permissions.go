@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ActionTypePermissions = "permissions"
+
+	paramUID              = "uid"
+	paramGID              = "gid"
+	paramMode             = "mode"
+	paramSELinuxContext   = "seLinuxContext"
+	paramAllowedOverrides = "allowedOverrides"
+
+	// gidFromFSGroup as gid takes the fsGroup of the pod using the claim
+	gidFromFSGroup = "fsGroup"
+
+	annotationPrefix = "local.path.provisioner/"
+
+	envVolUID            = "VOL_UID"
+	envVolGID            = "VOL_GID"
+	envVolDirMode        = "VOL_DIR_MODE"
+	envVolSELinuxContext = "VOL_SELINUX_CONTEXT"
+
+	// permissionsScript applies owner $2, group $3, mode $4 and SELinux
+	// context $5 to the volume directory $1, empty values are left alone
+	permissionsScript = `set -eu
+[ -z "$2" ] || chown "$2" "$1"
+[ -z "$3" ] || chgrp "$3" "$1"
+[ -z "$4" ] || chmod "$4" "$1"
+[ -z "$5" ] || chcon "$5" "$1"`
+)
+
+var (
+	dirModePattern        = regexp.MustCompile(`^[0-7]?[0-7]{3}$`)
+	seLinuxContextPattern = regexp.MustCompile(`^[a-zA-Z0-9_.]+:[a-zA-Z0-9_.]+:[a-zA-Z0-9_.]+(:[a-zA-Z0-9_.,:-]+)?$`)
+)
+
+// volumePermissions are the ownership, mode and SELinux context applied to a
+// new volume directory.
+type volumePermissions struct {
+	UID            string
+	GID            string
+	Mode           string
+	SELinuxContext string
+}
+
+// getVolumePermissions resolves the permissions of a new volume from the
+// storage class parameters, overridden by the local.path.provisioner/<param>
+// annotations of the claim for the parameters listed in allowedOverrides. It
+// returns nil when none is set, the directory is left as setup created it,
+// which is world writable with the shipped setup scripts. They keep their
+// mkdir -m 0777 for backward compatibility with existing workloads.
+func (p *LocalPathProvisioner) getVolumePermissions(storageClass *storagev1.StorageClass, pvc *v1.PersistentVolumeClaim) (*volumePermissions, error) {
+	perm, err := parseVolumePermissions(storageClass, pvc)
+	if err != nil || perm == nil {
+		return nil, err
+	}
+	if perm.GID == gidFromFSGroup {
+		if perm.GID, err = p.getClaimFSGroup(pvc); err != nil {
+			return nil, errors.Wrapf(err, "invalid volume permissions")
+		}
+	}
+	return perm, nil
+}
+
+// parseVolumePermissions checks the permissions of a new volume without
+// looking them up in the cluster, the gid is left as fsGroup when it is taken
+// from the pod. It returns nil when no permission is set.
+func parseVolumePermissions(storageClass *storagev1.StorageClass, pvc *v1.PersistentVolumeClaim) (perm *volumePermissions, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "invalid volume permissions")
+	}()
+
+	allowed := map[string]bool{}
+	if overrides, ok := storageClass.Parameters[paramAllowedOverrides]; ok {
+		for _, param := range strings.Split(overrides, ",") {
+			param = strings.TrimSpace(param)
+			switch param {
+			case paramUID, paramGID, paramMode, paramSELinuxContext:
+				allowed[param] = true
+			default:
+				return nil, fmt.Errorf("unknown parameter %q in %v of storage class %v", param, paramAllowedOverrides, storageClass.Name)
+			}
+		}
+	}
+	values := map[string]string{}
+	for _, param := range []string{paramUID, paramGID, paramMode, paramSELinuxContext} {
+		values[param] = storageClass.Parameters[param]
+		if val, ok := pvc.Annotations[annotationPrefix+param]; ok {
+			if !allowed[param] {
+				return nil, fmt.Errorf("annotation %v%v of claim %v/%v is not allowed by storage class %v", annotationPrefix, param, pvc.Namespace, pvc.Name, storageClass.Name)
+			}
+			values[param] = val
+		}
+	}
+
+	perm = &volumePermissions{
+		UID:            values[paramUID],
+		GID:            values[paramGID],
+		Mode:           values[paramMode],
+		SELinuxContext: values[paramSELinuxContext],
+	}
+	if *perm == (volumePermissions{}) {
+		return nil, nil
+	}
+	if perm.UID != "" {
+		if _, err := strconv.ParseUint(perm.UID, 10, 32); err != nil {
+			return nil, fmt.Errorf("uid %q is not a numeric id", perm.UID)
+		}
+	}
+	if perm.GID != "" && perm.GID != gidFromFSGroup {
+		if _, err := strconv.ParseUint(perm.GID, 10, 32); err != nil {
+			return nil, fmt.Errorf("gid %q is not a numeric id or %v", perm.GID, gidFromFSGroup)
+		}
+	}
+	if perm.Mode == "" {
+		switch {
+		case perm.GID != "":
+			// like kubelet does for fsGroup, new files inherit the group
+			perm.Mode = "2770"
+		case perm.UID != "":
+			perm.Mode = "0700"
+		}
+	} else if !dirModePattern.MatchString(perm.Mode) {
+		return nil, fmt.Errorf("mode %q is not an octal mode", perm.Mode)
+	}
+	if perm.SELinuxContext != "" && !seLinuxContextPattern.MatchString(perm.SELinuxContext) {
+		return nil, fmt.Errorf("seLinuxContext %q is not a user:role:type[:level] context", perm.SELinuxContext)
+	}
+	return perm, nil
+}
+
+// getClaimFSGroup returns the fsGroup of a pod using the claim. With
+// WaitForFirstConsumer the pod which triggered provisioning exists already,
+// and is pending until the volume is bound.
+func (p *LocalPathProvisioner) getClaimFSGroup(pvc *v1.PersistentVolumeClaim) (string, error) {
+	// served from the watch cache of the API server
+	pods, err := p.kubeClient.CoreV1().Pods(pvc.Namespace).List(context.TODO(), metav1.ListOptions{
+		FieldSelector:   "status.phase=" + string(v1.PodPending),
+		ResourceVersion: "0",
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.FSGroup == nil {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvc.Name {
+				return strconv.FormatInt(*pod.Spec.SecurityContext.FSGroup, 10), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("gid is %v but no pod using claim %v/%v sets an fsGroup", gidFromFSGroup, pvc.Namespace, pvc.Name)
+}
+
+func (perm *volumePermissions) env() []v1.EnvVar {
+	return []v1.EnvVar{
+		{Name: envVolUID, Value: perm.UID},
+		{Name: envVolGID, Value: perm.GID},
+		{Name: envVolDirMode, Value: perm.Mode},
+		{Name: envVolSELinuxContext, Value: perm.SELinuxContext},
+	}
+}
+
+// applyVolumePermissions sets the permissions of the volume directory path on
+// node once the setup script has created it.
+func (p *LocalPathProvisioner) applyVolumePermissions(node, path string, perm *volumePermissions) error {
+	helperPod := p.newPermissionsHelperPod(node, path, perm)
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		return errors.Wrapf(err, "failed to set permissions of %v", path)
+	}
+	return nil
+}
+
+func (p *LocalPathProvisioner) newPermissionsHelperPod(node, path string, perm *volumePermissions) *v1.Pod {
+	return p.newNodeHelperPod(ActionTypePermissions, node, createMounts(path), permissionsScript,
+		[]string{path, perm.UID, perm.GID, perm.Mode, perm.SELinuxContext})
+}
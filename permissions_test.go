@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseVolumePermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]string
+		annotations map[string]string
+		want        *volumePermissions
+		wantErr     bool
+	}{
+		{
+			name: "nothing set",
+			want: nil,
+		},
+		{
+			name:   "uid only defaults to 0700",
+			params: map[string]string{paramUID: "1000"},
+			want:   &volumePermissions{UID: "1000", Mode: "0700"},
+		},
+		{
+			name:   "gid defaults to setgid 2770",
+			params: map[string]string{paramGID: "2000"},
+			want:   &volumePermissions{GID: "2000", Mode: "2770"},
+		},
+		{
+			name:   "gid from the fsGroup of the pod",
+			params: map[string]string{paramGID: gidFromFSGroup},
+			want:   &volumePermissions{GID: gidFromFSGroup, Mode: "2770"},
+		},
+		{
+			name:   "mode only",
+			params: map[string]string{paramMode: "0755"},
+			want:   &volumePermissions{Mode: "0755"},
+		},
+		{
+			name:   "three digit mode",
+			params: map[string]string{paramUID: "1000", paramMode: "750"},
+			want:   &volumePermissions{UID: "1000", Mode: "750"},
+		},
+		{
+			name:   "SELinux context only",
+			params: map[string]string{paramSELinuxContext: "system_u:object_r:container_file_t:s0"},
+			want:   &volumePermissions{SELinuxContext: "system_u:object_r:container_file_t:s0"},
+		},
+		{
+			name:        "allowed override",
+			params:      map[string]string{paramUID: "1000", paramAllowedOverrides: "uid, mode"},
+			annotations: map[string]string{annotationPrefix + paramUID: "1001"},
+			want:        &volumePermissions{UID: "1001", Mode: "0700"},
+		},
+		{
+			name:        "override not allowed",
+			params:      map[string]string{paramUID: "1000", paramAllowedOverrides: "mode"},
+			annotations: map[string]string{annotationPrefix + paramUID: "1001"},
+			wantErr:     true,
+		},
+		{
+			name:    "unknown allowed override",
+			params:  map[string]string{paramAllowedOverrides: "owner"},
+			wantErr: true,
+		},
+		{
+			name:    "non numeric uid",
+			params:  map[string]string{paramUID: "nobody"},
+			wantErr: true,
+		},
+		{
+			name:    "non numeric gid",
+			params:  map[string]string{paramGID: "users"},
+			wantErr: true,
+		},
+		{
+			name:    "non octal mode",
+			params:  map[string]string{paramMode: "0778"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid SELinux context",
+			params:  map[string]string{paramSELinuxContext: "container_file_t"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "local-path"},
+				Parameters: tt.params,
+			}
+			pvc := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", Annotations: tt.annotations},
+			}
+			got, err := parseVolumePermissions(sc, pvc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVolumePermissions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseVolumePermissions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+)
+
+const (
+	// planPVName is the name of the planned PV of a claim manifest without
+	// uid, the provision controller names PVs after the uid of their claim
+	planPVName = "pvc-00000000-0000-0000-0000-000000000000"
+)
+
+func PlanCmd() cli.Command {
+	return cli.Command{
+		Name:  "plan",
+		Usage: "Print the PV and helper pods provisioning a claim would create, without creating anything",
+		Flags: append(provisionerFlags(),
+			cli.StringFlag{
+				Name:  FlagPVCFile,
+				Usage: "Required. Manifest of the claim, YAML or JSON.",
+			},
+			cli.StringFlag{
+				Name:  FlagStorageClassFile,
+				Usage: "Required. Manifest of the storage class of the claim, YAML or JSON.",
+			},
+			cli.StringFlag{
+				Name:  FlagNode,
+				Usage: "Node the claim is provisioned on. Required unless sharedFileSystemPath is used.",
+			},
+			cli.StringFlag{
+				Name:  FlagPVName,
+				Usage: "Name of the PV. Defaults to the one the provision controller derives from the uid of the claim.",
+			},
+		),
+		Action: func(c *cli.Context) {
+			if err := planClaim(c, os.Stdout); err != nil {
+				logrus.Fatalf("Error planning volume: %v", err)
+			}
+		},
+	}
+}
+
+func planClaim(c *cli.Context, out io.Writer) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := loadManifest(c.String(FlagPVCFile), FlagPVCFile, pvc); err != nil {
+		return err
+	}
+	if pvc.Namespace == "" {
+		pvc.Namespace = metav1.NamespaceDefault
+	}
+	storageClass := &storagev1.StorageClass{}
+	if err := loadManifest(c.String(FlagStorageClassFile), FlagStorageClassFile, storageClass); err != nil {
+		return err
+	}
+	if storageClass.ReclaimPolicy == nil {
+		// defaulted by the API server
+		reclaimPolicy := v1.PersistentVolumeReclaimDelete
+		storageClass.ReclaimPolicy = &reclaimPolicy
+	}
+	name := c.String(FlagPVName)
+	if name == "" {
+		name = planPVName
+		if pvc.UID != "" {
+			name = "pvc-" + string(pvc.UID)
+		}
+	}
+
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	if storageClass.Provisioner != p.provisionerName {
+		return fmt.Errorf("storage class %v is not served by %v but by %v", storageClass.Name, p.provisionerName, storageClass.Provisioner)
+	}
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return err
+	}
+	var node *v1.Node
+	if nodeName := c.String(FlagNode); nodeName != "" {
+		if node, err = p.kubeClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+			logrus.Warnf("Node %v does not exist, planning without its labels", nodeName)
+			node = &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}}
+		} else if err != nil {
+			return err
+		}
+	} else if !sharedFS {
+		return fmt.Errorf("invalid empty flag %v", FlagNode)
+	}
+
+	if err := validateClaim(pvc, storageClass, sharedFS); err != nil {
+		return err
+	}
+	if pvc.Spec.Selector != nil {
+		return fmt.Errorf("claim %v/%v has a selector, it is bound to a catalog volume instead of a new one", pvc.Namespace, pvc.Name)
+	}
+	plan, err := p.planVolume(pvController.ProvisionOptions{
+		StorageClass: storageClass,
+		PVName:       name,
+		PVC:          pvc,
+		SelectedNode: node,
+	}, sharedFS)
+	if err != nil {
+		return err
+	}
+
+	// the fields the provision controller adds to the PV returned by Provision
+	pv := plan.pv
+	pv.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[annProvisionedBy] = p.provisionerName
+	pv.Spec.StorageClassName = storageClass.Name
+	pv.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  pvc.Namespace,
+		Name:       pvc.Name,
+		UID:        pvc.UID,
+	}
+	objects := []interface{}{pv}
+
+	helperPod, err := p.newVolumeHelperPod(ActionTypeCreate, setupCmd, plan.volumeOptions(pvc), pvc.Annotations)
+	if err != nil {
+		return err
+	}
+	helperPods := []*v1.Pod{helperPod}
+	if plan.dataSourcePath != "" {
+		helperPods = append(helperPods, p.newCopyHelperPod(plan.node, plan.dataSourcePath, plan.path))
+	}
+	if plan.perm != nil {
+		helperPods = append(helperPods, p.newPermissionsHelperPod(plan.node, plan.path, plan.perm))
+	}
+	for _, pod := range helperPods {
+		pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+		objects = append(objects, pod)
+	}
+
+	for i, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		fmt.Fprint(out, string(data))
+	}
+	return nil
+}
+
+// loadManifest decodes the YAML or JSON manifest in file into obj.
+func loadManifest(file, flag string, obj interface{}) error {
+	if file == "" {
+		return fmt.Errorf("invalid empty flag %v", flag)
+	}
+	data, err := loadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "invalid flag %v", flag)
+	}
+	if err := yaml.Unmarshal([]byte(data), obj); err != nil {
+		return errors.Wrapf(err, "invalid manifest %v", file)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// provisionerProfile is what a provisioner name is served with: its config,
+// the ConfigMap holding its scripts and its helper pod.
+type provisionerProfile struct {
+	name          string
+	configFile    string
+	configMapName string
+	helperImage   string
+	helperPodFile string
+}
+
+// parseProvisionerProfile parses a value of the provisioner name flag, a name
+// optionally followed by settings of its profile, named after the flags they
+// replace, e.g.
+//
+//	rancher.io/local-model-cache:configmap-name=local-model-cache-config,helper-image=morpheusph/modelcache:dev
+//
+// Settings left out are taken from defaults, the profile built from the flags.
+func parseProvisionerProfile(value string, defaults provisionerProfile) (provisionerProfile, error) {
+	profile := defaults
+	settings := ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		value, settings = value[:i], value[i+1:]
+	}
+	profile.name = strings.TrimSpace(value)
+	if profile.name == "" || strings.ContainsAny(profile.name, "=,") {
+		return profile, fmt.Errorf("invalid provisioner name %q", profile.name)
+	}
+	if settings == "" {
+		return profile, nil
+	}
+	for _, setting := range strings.Split(settings, ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return profile, fmt.Errorf("invalid setting %q of provisioner %v, must be key=value", setting, profile.name)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case FlagConfigFile:
+			profile.configFile = kv[1]
+		case FlagConfigMapName:
+			profile.configMapName = kv[1]
+		case FlagHelperImage:
+			profile.helperImage = kv[1]
+		case FlagHelperPodFile:
+			profile.helperPodFile = kv[1]
+		default:
+			return profile, fmt.Errorf("unknown setting %v of provisioner %v, must be one of %v, %v, %v or %v",
+				kv[0], profile.name, FlagConfigFile, FlagConfigMapName, FlagHelperImage, FlagHelperPodFile)
+		}
+	}
+	return profile, nil
+}
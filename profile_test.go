@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestParseProvisionerProfile(t *testing.T) {
+	defaults := provisionerProfile{
+		name:          "rancher.io/local-path",
+		configFile:    "/etc/config/config.json",
+		configMapName: "local-path-config",
+		helperImage:   "busybox",
+		helperPodFile: "/etc/config/helperPod.yaml",
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    provisionerProfile
+		wantErr bool
+	}{
+		{
+			name:  "name only",
+			value: "rancher.io/local-path",
+			want:  defaults,
+		},
+		{
+			name:  "name is trimmed",
+			value: " rancher.io/local-path ",
+			want:  defaults,
+		},
+		{
+			name:  "some settings",
+			value: "rancher.io/local-model-cache:configmap-name=local-model-cache-config,helper-image=morpheusph/modelcache:dev",
+			want: provisionerProfile{
+				name:          "rancher.io/local-model-cache",
+				configFile:    defaults.configFile,
+				configMapName: "local-model-cache-config",
+				helperImage:   "morpheusph/modelcache:dev",
+				helperPodFile: defaults.helperPodFile,
+			},
+		},
+		{
+			name:  "all settings",
+			value: "example.com/nfs:config=/etc/nfs/config.json,configmap-name=nfs-config,helper-image=alpine,helper-pod-file=/etc/nfs/helperPod.yaml",
+			want: provisionerProfile{
+				name:          "example.com/nfs",
+				configFile:    "/etc/nfs/config.json",
+				configMapName: "nfs-config",
+				helperImage:   "alpine",
+				helperPodFile: "/etc/nfs/helperPod.yaml",
+			},
+		},
+		{
+			name:  "empty settings",
+			value: "example.com/nfs:",
+			want: provisionerProfile{
+				name:          "example.com/nfs",
+				configFile:    defaults.configFile,
+				configMapName: defaults.configMapName,
+				helperImage:   defaults.helperImage,
+				helperPodFile: defaults.helperPodFile,
+			},
+		},
+		{
+			name:    "empty name",
+			value:   ":helper-image=alpine",
+			wantErr: true,
+		},
+		{
+			name:    "settings without the colon",
+			value:   "example.com/nfs,helper-image=alpine",
+			wantErr: true,
+		},
+		{
+			name:    "setting without value",
+			value:   "example.com/nfs:helper-image=",
+			wantErr: true,
+		},
+		{
+			name:    "setting without key",
+			value:   "example.com/nfs:alpine",
+			wantErr: true,
+		},
+		{
+			name:    "unknown setting",
+			value:   "example.com/nfs:namespace=nfs",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProvisionerProfile(tt.value, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProvisionerProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseProvisionerProfile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,8 +20,13 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
 )
@@ -36,6 +41,8 @@ const (
 const (
 	KeyNode = "kubernetes.io/hostname"
 
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
 	NodeDefaultNonListedNodes = "DEFAULT_PATH_FOR_NON_LISTED_NODES"
 
 	helperScriptDir     = "/script"
@@ -48,22 +55,40 @@ const (
 	envRegistry  = "REGISTRY"
 	envStoreType = "STORAGE_TYPE"
 	envREPOTAG   = "REPO_TAG"
+
+	envVolBlockImage  = "VOL_BLOCK_IMAGE"
+	envVolBlockDevice = "VOL_BLOCK_DEVICE"
+
+	blockImageFile  = "disk.img"
+	blockDeviceFile = "device"
 )
 
 const (
-	defaultCmdTimeoutSeconds = 120
-	defaultVolumeType        = "hostPath"
+	defaultCmdTimeoutSeconds     = 120
+	defaultVolumeType            = "hostPath"
+	defaultTrashRetentionSeconds = 7 * 24 * 60 * 60
 )
 
 var (
 	ConfigFileCheckInterval = 30 * time.Second
 
 	HelperPodNameMaxLength = 128
+
+	// setupCmd and teardownCmd run the scripts of the ConfigMap in the helper pods
+	setupCmd    = []string{"/bin/sh", "/script/setup"}
+	teardownCmd = []string{"/bin/sh", "/script/teardown"}
 )
 
+// modelPullScript runs the setup script of a model cache volume and prints
+// the size of the pulled model in KiB, read back by modelPullSizeFromLogs.
+const modelPullScript = `/bin/sh /script/setup "$@" && echo "pulled-kb $(du -sk "$VOL_DIR" | cut -f1)"`
+
 type LocalPathProvisioner struct {
 	ctx                context.Context
 	kubeClient         *clientset.Clientset
+	dynamicClient      dynamic.Interface
+	eventRecorder      record.EventRecorder
+	provisionerName    string
 	namespace          string
 	helperImage        string
 	serviceAccountName string
@@ -80,6 +105,23 @@ type LocalPathProvisioner struct {
 	storeType     string
 	defaultMount  string
 	owner         string
+
+	catalogMutex        *sync.Mutex
+	catalogReservations map[string]catalogReservation
+
+	quotaMutex        *sync.Mutex
+	quotaReservations map[string]quotaReservation
+
+	usedBytesSeries     *gaugeSeries
+	capacityBytesSeries *gaugeSeries
+	abnormalSeries      *gaugeSeries
+
+	operations  *operationTracker
+	helperSlots *helperLimiter
+	// helperCtx outlives ctx by the shutdown grace period, helper pods in
+	// flight are waited for until it is done
+	helperCtx   context.Context
+	stopHelpers context.CancelFunc
 }
 
 type NodePathMapData struct {
@@ -88,9 +130,15 @@ type NodePathMapData struct {
 }
 
 type ConfigData struct {
-	NodePathMap          []*NodePathMapData `json:"nodePathMap,omitempty"`
-	CmdTimeoutSeconds    int                `json:"cmdTimeoutSeconds,omitempty"`
-	SharedFileSystemPath string             `json:"sharedFileSystemPath,omitempty"`
+	NodePathMap           []*NodePathMapData   `json:"nodePathMap,omitempty"`
+	CmdTimeoutSeconds     int                  `json:"cmdTimeoutSeconds,omitempty"`
+	SharedFileSystemPath  string               `json:"sharedFileSystemPath,omitempty"`
+	TrashRetentionSeconds int                  `json:"trashRetentionSeconds,omitempty"`
+	VolumeCatalog         []*CatalogVolumeData `json:"volumeCatalog,omitempty"`
+	HelperConcurrency     *HelperConcurrency   `json:"helperConcurrency,omitempty"`
+	Quotas                []*QuotaData         `json:"quotas,omitempty"`
+	DeletedNodePolicy     string               `json:"deletedNodePolicy,omitempty"`
+	BlockVolumes          bool                 `json:"blockVolumes,omitempty"`
 }
 
 type NodePathMap struct {
@@ -98,9 +146,15 @@ type NodePathMap struct {
 }
 
 type Config struct {
-	NodePathMap          map[string]*NodePathMap
-	CmdTimeoutSeconds    int
-	SharedFileSystemPath string
+	NodePathMap           map[string]*NodePathMap
+	CmdTimeoutSeconds     int
+	SharedFileSystemPath  string
+	TrashRetentionSeconds int
+	VolumeCatalog         []*CatalogVolume
+	HelperConcurrency     HelperConcurrency
+	Quotas                []*Quota
+	DeletedNodePolicy     string
+	BlockVolumes          bool
 }
 
 type pvcMetadata struct {
@@ -138,16 +192,17 @@ func (meta *pvcMetadata) stringParser(str string) string {
 	if add_pvc_name {
 		str = filepath.Join(str, meta.data["name"])
 	}
-	logrus.Infof("path %s", str)
 	return str
 }
 
-func NewProvisioner(ctx context.Context, kubeClient *clientset.Clientset,
-	configFile, namespace, helperImage, configMapName, serviceAccountName, helperPodYaml string) (*LocalPathProvisioner, error) {
+func NewProvisioner(ctx context.Context, kubeClient *clientset.Clientset, dynamicClient dynamic.Interface,
+	provisionerName, configFile, namespace, helperImage, configMapName, serviceAccountName, helperPodYaml string) (*LocalPathProvisioner, error) {
 	p := &LocalPathProvisioner{
 		ctx: ctx,
 
 		kubeClient:         kubeClient,
+		dynamicClient:      dynamicClient,
+		provisionerName:    provisionerName,
 		namespace:          namespace,
 		helperImage:        helperImage,
 		serviceAccountName: serviceAccountName,
@@ -163,7 +218,25 @@ func NewProvisioner(ctx context.Context, kubeClient *clientset.Clientset,
 		storeType:     "",
 		defaultMount:  "/model",
 		owner:         "public",
+
+		catalogMutex:        &sync.Mutex{},
+		catalogReservations: map[string]catalogReservation{},
+
+		quotaMutex:        &sync.Mutex{},
+		quotaReservations: map[string]quotaReservation{},
+
+		usedBytesSeries:     newGaugeSeries(volumeUsedBytes),
+		capacityBytesSeries: newGaugeSeries(volumeCapacityBytes),
+		abnormalSeries:      newGaugeSeries(volumeAbnormal),
+
+		operations: newOperationTracker(),
 	}
+	p.helperSlots = newHelperLimiter(p.helperConcurrency)
+	p.helperCtx, p.stopHelpers = context.WithCancel(context.Background())
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	p.eventRecorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: provisionerName})
+
 	var err error
 	p.helperPod, err = loadHelperPodFile(helperPodYaml)
 	if err != nil {
@@ -180,8 +253,11 @@ func (p *LocalPathProvisioner) refreshConfig() error {
 	p.configMutex.Lock()
 	defer p.configMutex.Unlock()
 
+	log := logrus.WithField(logFieldAction, actionConfigReload)
 	configData, err := loadConfigFile(p.configFile)
 	if err != nil {
+		configReloads.WithLabelValues(p.provisionerName, "failure").Inc()
+		configLastReloadSuccessful.WithLabelValues(p.provisionerName).Set(0)
 		return err
 	}
 	// no need to update
@@ -190,8 +266,12 @@ func (p *LocalPathProvisioner) refreshConfig() error {
 	}
 	config, err := canonicalizeConfig(configData)
 	if err != nil {
+		configReloads.WithLabelValues(p.provisionerName, "failure").Inc()
+		configLastReloadSuccessful.WithLabelValues(p.provisionerName).Set(0)
 		return err
 	}
+	configReloads.WithLabelValues(p.provisionerName, "success").Inc()
+	configLastReloadSuccessful.WithLabelValues(p.provisionerName).Set(1)
 	// only update the config if the new config file is valid
 	p.configData = configData
 	p.config = config
@@ -200,7 +280,7 @@ func (p *LocalPathProvisioner) refreshConfig() error {
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Applied config: %v", string(output))
+	log.Debugf("Applied config: %v", string(output))
 
 	return err
 }
@@ -213,10 +293,12 @@ func (p *LocalPathProvisioner) watchAndRefreshConfig() {
 			select {
 			case <-ticker.C:
 				if err := p.refreshConfig(); err != nil {
-					logrus.Errorf("failed to load the new config file: %v", err)
+					logrus.WithField(logFieldAction, actionConfigReload).Errorf("failed to load the new config file: %v", err)
 				}
+				// raised limits let queued helper pods run
+				p.helperSlots.update()
 			case <-p.ctx.Done():
-				logrus.Infof("stop watching config file")
+				logrus.WithField(logFieldAction, actionConfigReload).Infof("stop watching config file")
 				return
 			}
 		}
@@ -268,6 +350,80 @@ func (p *LocalPathProvisioner) getPathOnNode(node string) (string, error) {
 	return path, nil
 }
 
+// getBasePathForVolume returns the configured path on node which contains the
+// volume directory path, or the parent of path if none of them does.
+func (p *LocalPathProvisioner) getBasePathForVolume(node, path string) string {
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+
+	basePath := filepath.Dir(path)
+	if p.config == nil {
+		return basePath
+	}
+	var candidates []string
+	if p.config.SharedFileSystemPath != "" {
+		candidates = append(candidates, filepath.Clean(p.config.SharedFileSystemPath))
+	}
+	npMap := p.config.NodePathMap[node]
+	if npMap == nil {
+		npMap = p.config.NodePathMap[NodeDefaultNonListedNodes]
+	}
+	if npMap != nil {
+		for c := range npMap.Paths {
+			candidates = append(candidates, c)
+		}
+	}
+	longest := ""
+	for _, c := range candidates {
+		if strings.HasPrefix(path, c+string(filepath.Separator)) && len(c) > len(longest) {
+			longest = c
+		}
+	}
+	if longest != "" {
+		basePath = longest
+	}
+	return basePath
+}
+
+// getPathsByNode returns the configured paths of every node in the cluster.
+// On a shared filesystem its path is returned for the empty node name.
+func (p *LocalPathProvisioner) getPathsByNode() (map[string][]string, error) {
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []v1.Node
+	if !sharedFS {
+		nodeList, err := p.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = nodeList.Items
+	}
+
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+
+	if sharedFS {
+		return map[string][]string{"": {filepath.Clean(p.config.SharedFileSystemPath)}}, nil
+	}
+	pathsByNode := map[string][]string{}
+	for _, node := range nodes {
+		npMap := p.config.NodePathMap[node.Name]
+		if npMap == nil {
+			npMap = p.config.NodePathMap[NodeDefaultNonListedNodes]
+		}
+		if npMap == nil || len(npMap.Paths) == 0 {
+			continue
+		}
+		for path := range npMap.Paths {
+			pathsByNode[node.Name] = append(pathsByNode[node.Name], path)
+		}
+		sort.Strings(pathsByNode[node.Name])
+	}
+	return pathsByNode, nil
+}
+
 func (p *LocalPathProvisioner) isSharedFilesystem() (bool, error) {
 	p.configMutex.RLock()
 	defer p.configMutex.RUnlock()
@@ -292,7 +448,23 @@ func (p *LocalPathProvisioner) isSharedFilesystem() (bool, error) {
 	return false, fmt.Errorf("both nodePathMap and sharedFileSystemPath are unconfigured")
 }
 
+// SupportsBlock reports whether raw block claims can be served. Block volumes
+// are loop devices backed by image files, so they are only available on node
+// local paths where the device stays attached to the node it was set up on.
+// The default setup and teardown scripts only handle directories, so block
+// volumes must be enabled with blockVolumes together with block aware scripts.
+func (p *LocalPathProvisioner) SupportsBlock(ctx context.Context) bool {
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil || sharedFS {
+		return false
+	}
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+	return p.config.BlockVolumes
+}
+
 func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.ProvisionOptions) (*v1.PersistentVolume, pvController.ProvisioningState, error) {
+	defer p.operations.beginVolume("provisioning volume %v", opts.PVName)()
 	pvc := opts.PVC
 	node := opts.SelectedNode
 	storageClass := opts.StorageClass
@@ -300,18 +472,88 @@ func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.
 	if err != nil {
 		return nil, pvController.ProvisioningFinished, err
 	}
+	if err := validateClaim(pvc, storageClass, sharedFS); err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
 	if !sharedFS {
-		if pvc.Spec.Selector != nil {
-			return nil, pvController.ProvisioningFinished, fmt.Errorf("claim.Spec.Selector is not supported")
+		if node == nil && pvc.Spec.Selector == nil {
+			return nil, pvController.ProvisioningFinished, fmt.Errorf("configuration error, no node was specified")
 		}
-		for _, accessMode := range pvc.Spec.AccessModes {
-			if accessMode != v1.ReadWriteOnce {
-				return nil, pvController.ProvisioningFinished, fmt.Errorf("Only support ReadWriteOnce access mode")
-			}
+		if node != nil && isDraining(node) {
+			// let the scheduler pick another node
+			return nil, pvController.ProvisioningReschedule, fmt.Errorf("node %v is draining, no new volumes are placed on it", node.Name)
 		}
-		if node == nil {
-			return nil, pvController.ProvisioningFinished, fmt.Errorf("configuration error, no node was specified")
+	}
+	if pvc.Spec.Selector != nil {
+		return p.provisionFromCatalog(opts, sharedFS)
+	}
+
+	plan, err := p.planVolume(opts, sharedFS)
+	if err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
+	name, nodeName, path := plan.name, plan.node, plan.path
+
+	if err := p.checkQuotas(pvc, name, node, plan.basePath, plan.storage); err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
+	provisioned := false
+	defer func() {
+		if !provisioned {
+			p.releaseQuotaReservation(name)
 		}
+	}()
+
+	log := volumeLog(pvc.Namespace, pvc.Name, name, nodeName).WithField(logFieldAction, ActionTypeCreate)
+	if nodeName == "" {
+		log.Infof("Creating volume %v at %v", name, path)
+	} else {
+		log.Infof("Creating volume %v at %v:%v", name, nodeName, path)
+	}
+
+	if err := p.createHelperPod(ActionTypeCreate, setupCmd, plan.volumeOptions(pvc), pvc.Annotations); err != nil {
+		return nil, pvController.ProvisioningFinished, err
+	}
+	if plan.dataSourcePath != "" {
+		log.Infof("Populating volume %v from %v", name, plan.dataSourcePath)
+		if err := p.copyVolumeData(nodeName, plan.dataSourcePath, path); err != nil {
+			return nil, pvController.ProvisioningFinished, err
+		}
+	}
+	if plan.perm != nil {
+		if err := p.applyVolumePermissions(nodeName, path, plan.perm); err != nil {
+			return nil, pvController.ProvisioningFinished, err
+		}
+	}
+
+	provisioned = true
+	return plan.pv, pvController.ProvisioningFinished, nil
+}
+
+// volumePlan is where and how Provision creates a new volume directory,
+// worked out before anything is created.
+type volumePlan struct {
+	name           string
+	node           string
+	basePath       string
+	path           string
+	mode           v1.PersistentVolumeMode
+	storage        resource.Quantity
+	dataSourcePath string
+	modelCache     bool
+	perm           *volumePermissions
+	pv             *v1.PersistentVolume
+}
+
+// planVolume picks the path of the volume for a claim validated by
+// validateClaim and builds its PV, without creating anything.
+func (p *LocalPathProvisioner) planVolume(opts pvController.ProvisionOptions, sharedFS bool) (*volumePlan, error) {
+	pvc := opts.PVC
+	node := opts.SelectedNode
+	storageClass := opts.StorageClass
+	volumeMode := v1.PersistentVolumeFilesystem
+	if pvc.Spec.VolumeMode != nil {
+		volumeMode = *pvc.Spec.VolumeMode
 	}
 
 	nodeName := ""
@@ -327,23 +569,21 @@ func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.
 	// }
 	basePath, err := p.getPathOnNode(nodeName)
 	if err != nil {
-		return nil, pvController.ProvisioningFinished, err
+		return nil, err
+	}
+
+	dataSourcePath := ""
+	if pvc.Spec.DataSource != nil {
+		dataSourcePath, err = p.getDataSourcePath(pvc, nodeName, sharedFS)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	name := opts.PVName
 	folderName := strings.Join([]string{name, opts.PVC.Namespace, opts.PVC.Name}, "_")
 	path := filepath.Join(basePath, folderName)
 
-	metadata := &pvcMetadata{
-		data: map[string]string{
-			"name":      pvc.Name,
-			"namespace": pvc.Namespace,
-		},
-		labels:      pvc.Labels,
-		annotations: pvc.Annotations,
-		emptyPath:   true,
-	}
-
 	owner, exists := pvc.Labels["owner"]
 	if exists {
 		p.owner = owner
@@ -355,63 +595,114 @@ func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.
 		if exists {
 			modelCache, err = strconv.ParseBool(isModelCache)
 			if err != nil {
-				return nil, pvController.ProvisioningFinished, err
+				return nil, err
 			}
 			registry, exists := storageClass.Parameters["registry"]
 			if !exists {
-				return nil, pvController.ProvisioningFinished, fmt.Errorf("The registry parameter must be set")
+				return nil, fmt.Errorf("The registry parameter must be set")
 			}
 			p.registry = registry
 
 			storeType, exists := storageClass.Parameters["storeType"]
 			if !exists {
-				return nil, pvController.ProvisioningFinished, fmt.Errorf("The storeType parameter must be set")
+				return nil, fmt.Errorf("The storeType parameter must be set")
 			}
 			p.storeType = storeType
 		}
 		pathPattern, exists := opts.StorageClass.Parameters["pathPattern"]
 		if exists {
-			customPath := metadata.stringParser(pathPattern)
+			customPath, err := expandPathPattern(pathPattern, pvc, modelCache)
+			if err != nil {
+				return nil, err
+			}
 			p.modelPath = customPath
-			if !metadata.emptyPath && customPath != "" {
+			if customPath != "" {
 				path = filepath.Join(basePath, customPath)
 			}
 		}
 	}
-	if nodeName == "" {
-		logrus.Infof("Creating volume %v at %v", name, path)
-	} else {
-		logrus.Infof("Creating volume %v at %v:%v", name, nodeName, path)
+	deleteMode := storageClass.Parameters["deleteMode"]
+
+	var perm *volumePermissions
+	if volumeMode == v1.PersistentVolumeFilesystem {
+		if perm, err = p.getVolumePermissions(storageClass, pvc); err != nil {
+			return nil, err
+		}
 	}
 
 	storage := pvc.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
-	provisionCmd := []string{"/bin/sh", "/script/setup"}
-	if err := p.createHelperPod(ActionTypeCreate, provisionCmd, volumeOptions{
-		Name:        name,
-		Path:        path,
-		Mode:        *pvc.Spec.VolumeMode,
-		SizeInBytes: storage.Value(),
-		Node:        nodeName,
-		ModelCache:  modelCache,
-	}, pvc.Annotations); err != nil {
-		return nil, pvController.ProvisioningFinished, err
+	volumeType := getVolumeType(opts.StorageClass.GetAnnotations(), opts.PVC.GetAnnotations())
+	pv, err := newPersistentVolume(name, path, volumeType, volumeMode, node, sharedFS)
+	if err != nil {
+		return nil, err
 	}
+	pv.Spec.PersistentVolumeReclaimPolicy = *opts.StorageClass.ReclaimPolicy
+	pv.Spec.AccessModes = pvc.Spec.AccessModes
+	pv.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): storage,
+	}
+	if deleteMode == DeleteModeTrash {
+		pv.Annotations = map[string]string{AnnotationDeleteMode: DeleteModeTrash}
+	}
+	return &volumePlan{
+		name:           name,
+		node:           nodeName,
+		basePath:       basePath,
+		path:           path,
+		mode:           volumeMode,
+		storage:        storage,
+		dataSourcePath: dataSourcePath,
+		modelCache:     modelCache,
+		perm:           perm,
+		pv:             pv,
+	}, nil
+}
 
-	fs := v1.PersistentVolumeFilesystem
+// volumeOptions are the options of the helper pod setting up the volume of
+// plan for pvc.
+func (plan *volumePlan) volumeOptions(pvc *v1.PersistentVolumeClaim) volumeOptions {
+	return volumeOptions{
+		Name:        plan.name,
+		Path:        plan.path,
+		Mode:        plan.mode,
+		SizeInBytes: plan.storage.Value(),
+		Node:        plan.node,
+		ModelCache:  plan.modelCache,
+		Permissions: plan.perm,
+
+		ClaimNamespace: pvc.Namespace,
+		ClaimName:      pvc.Name,
+	}
+}
 
-	var pvs v1.PersistentVolumeSource
-	var volumeType string
-	if dVal, ok := opts.StorageClass.GetAnnotations()["defaultVolumeType"]; ok {
+// getVolumeType returns the volume type requested by the claim annotations,
+// else the default of the storage class annotations.
+func getVolumeType(scAnnotations, pvcAnnotations map[string]string) string {
+	volumeType := defaultVolumeType
+	if dVal, ok := scAnnotations["defaultVolumeType"]; ok {
 		volumeType = dVal
-	} else {
-		volumeType = defaultVolumeType
 	}
-	if val, ok := opts.PVC.GetAnnotations()["volumeType"]; ok {
+	if val, ok := pvcAnnotations["volumeType"]; ok {
 		volumeType = val
 	}
-	pvs, err = createPersistentVolumeSource(volumeType, path)
+	return volumeType
+}
+
+// newPersistentVolume builds the PV for the volume directory path on node,
+// with the volume source and node affinity of a provisioned volume. Reclaim
+// policy, access modes and capacity are left to the caller.
+func newPersistentVolume(name, path, volumeType string, volumeMode v1.PersistentVolumeMode, node *v1.Node, sharedFS bool) (*v1.PersistentVolume, error) {
+	var pvs v1.PersistentVolumeSource
+	var err error
+	if volumeMode == v1.PersistentVolumeBlock {
+		// hostPath cannot carry a block device, the PV points at the loop
+		// device node created by the setup script instead
+		pvs, err = createPersistentVolumeSource("local", filepath.Join(path, blockDeviceFile))
+	} else {
+		pvs, err = createPersistentVolumeSource(volumeType, path)
+	}
 	if err != nil {
-		return nil, pvController.ProvisioningFinished, err
+		return nil, err
 	}
 
 	var nodeAffinity *v1.VolumeNodeAffinity
@@ -436,7 +727,7 @@ func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.
 	} else {
 		valueNode, ok := node.GetLabels()[KeyNode]
 		if !ok {
-			valueNode = nodeName
+			valueNode = node.Name
 		}
 		nodeAffinity = &v1.VolumeNodeAffinity{
 			Required: &v1.NodeSelector{
@@ -461,19 +752,15 @@ func (p *LocalPathProvisioner) Provision(ctx context.Context, opts pvController.
 			Name: name,
 		},
 		Spec: v1.PersistentVolumeSpec{
-			PersistentVolumeReclaimPolicy: *opts.StorageClass.ReclaimPolicy,
-			AccessModes:                   pvc.Spec.AccessModes,
-			VolumeMode:                    &fs,
-			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): pvc.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
-			},
+			VolumeMode:             &volumeMode,
 			PersistentVolumeSource: pvs,
 			NodeAffinity:           nodeAffinity,
 		},
-	}, pvController.ProvisioningFinished, nil
+	}, nil
 }
 
 func (p *LocalPathProvisioner) Delete(ctx context.Context, pv *v1.PersistentVolume) (err error) {
+	defer p.operations.beginVolume("deleting volume %v", pv.Name)()
 	defer func() {
 		err = errors.Wrapf(err, "failed to delete volume %v", pv.Name)
 	}()
@@ -481,27 +768,50 @@ func (p *LocalPathProvisioner) Delete(ctx context.Context, pv *v1.PersistentVolu
 	if err != nil {
 		return err
 	}
+	claimNamespace, claimName := pvClaim(pv)
+	log := volumeLog(claimNamespace, claimName, pv.Name, node)
+	if _, ok := pv.Annotations[AnnotationCatalogVolume]; ok {
+		// catalog volumes are not ours to tear down
+		p.releaseCatalogVolume(pv)
+		return nil
+	}
 	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		if node != "" {
+			// a helper pod for a node which is gone would never be scheduled
+			exists, err := p.nodeExists(node)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return p.deleteOnDeletedNode(pv, node, path)
+			}
+		}
+		if pv.Annotations[AnnotationDeleteMode] == DeleteModeTrash && !isBlockVolume(pv) {
+			return p.trashVolume(pv, path, node)
+		}
+		log = log.WithField(logFieldAction, ActionTypeDelete)
 		if node == "" {
-			logrus.Infof("Deleting volume %v at %v", pv.Name, path)
+			log.Infof("Deleting volume %v at %v", pv.Name, path)
 		} else {
-			logrus.Infof("Deleting volume %v at %v:%v", pv.Name, node, path)
+			log.Infof("Deleting volume %v at %v:%v", pv.Name, node, path)
 		}
 		storage := pv.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
-		cleanupCmd := []string{"/bin/sh", "/script/teardown"}
-		if err := p.createHelperPod(ActionTypeDelete, cleanupCmd, volumeOptions{
+		if err := p.createHelperPod(ActionTypeDelete, teardownCmd, volumeOptions{
 			Name:        pv.Name,
 			Path:        path,
 			Mode:        *pv.Spec.VolumeMode,
 			SizeInBytes: storage.Value(),
 			Node:        node,
+
+			ClaimNamespace: claimNamespace,
+			ClaimName:      claimName,
 		}, nil); err != nil {
-			logrus.Infof("clean up volume %v failed: %v", pv.Name, err)
+			log.Infof("clean up volume %v failed: %v", pv.Name, err)
 			return err
 		}
 		return nil
 	}
-	logrus.Infof("Retained volume %v", pv.Name)
+	log.Infof("Retained volume %v", pv.Name)
 	return nil
 }
 
@@ -518,6 +828,10 @@ func (p *LocalPathProvisioner) getPathAndNodeForPV(pv *v1.PersistentVolume) (pat
 	} else {
 		return "", "", fmt.Errorf("no path set")
 	}
+	if isBlockVolume(pv) {
+		// block volumes point at the device node inside the volume directory
+		path = filepath.Dir(path)
+	}
 
 	sharedFS, err := p.isSharedFilesystem()
 	if err != nil {
@@ -561,6 +875,10 @@ func (p *LocalPathProvisioner) getPathAndNodeForPV(pv *v1.PersistentVolume) (pat
 	return path, node, nil
 }
 
+func isBlockVolume(pv *v1.PersistentVolume) bool {
+	return pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == v1.PersistentVolumeBlock
+}
+
 type volumeOptions struct {
 	Name        string
 	Path        string
@@ -568,21 +886,146 @@ type volumeOptions struct {
 	SizeInBytes int64
 	Node        string
 	ModelCache  bool
+	Permissions *volumePermissions
+
+	// the claim of the volume, for the log lines
+	ClaimNamespace string
+	ClaimName      string
 }
 
 func (p *LocalPathProvisioner) createHelperPod(action ActionType, cmd []string, o volumeOptions, annotation map[string]string) (err error) {
 	defer func() {
 		err = errors.Wrapf(err, "failed to %v volume %v", action, o.Name)
 	}()
-	sharedFS, err := p.isSharedFilesystem()
+	helperPod, err := p.newVolumeHelperPod(action, cmd, o, annotation)
 	if err != nil {
 		return err
 	}
+
+	// If it already exists due to some previous errors, the pod will be cleaned up later automatically
+	// https://github.com/rancher/local-path-provisioner/issues/27
+	release, err := p.helperSlots.acquire(p.helperCtx, o.Node, o.ModelCache && action == ActionTypeCreate)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer p.operations.begin("helper pod %v", helperPod.Name)()
+
+	log := volumeLog(o.ClaimNamespace, o.ClaimName, o.Name, o.Node).WithFields(logrus.Fields{
+		logFieldAction:    action,
+		logFieldHelperPod: helperPod.Name,
+	})
+	ctx := p.helperCtx
+	helperPodExists := false
+	_, err = p.kubeClient.CoreV1().Pods(p.namespace).Get(ctx, helperPod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		helperPodExists = false
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to get helper pod %v", helperPod.Name)
+	} else {
+		helperPodExists = true
+		log.Infof("helper pod %s exists in namespace %s, skip creating it", helperPod.Name, p.namespace)
+	}
+
+	start := time.Now()
+	failure := helperFailureAPI
+	defer func() {
+		if err == nil {
+			failure = ""
+			if o.ModelCache && action == ActionTypeCreate {
+				modelPullDuration.WithLabelValues(o.Node).Observe(time.Since(start).Seconds())
+			}
+		}
+		p.observeHelperPod(action, o.Node, start, failure)
+	}()
+	if !helperPodExists {
+		log.Infof("create the helper pod %s into %s", helperPod.Name, p.namespace)
+		_, err = p.kubeClient.CoreV1().Pods(p.namespace).Create(ctx, helperPod, metav1.CreateOptions{})
+		if err != nil && !k8serror.IsAlreadyExists(err) {
+			failure = helperFailureCreate
+			return err
+		}
+	}
+	// an existing pod was left by a crash, a previous leader or a shutdown,
+	// once it is waited for it is ours to clean up as well, unless it is left
+	// to the next instance again
+	abandoned := false
+	defer func() {
+		if abandoned {
+			return
+		}
+		e := p.kubeClient.CoreV1().Pods(p.namespace).Delete(context.TODO(), helperPod.Name, metav1.DeleteOptions{})
+		if e != nil && !apierrors.IsNotFound(e) {
+			log.Errorf("unable to delete the helper pod: %v", e)
+		}
+	}()
+
+	completed := false
+	for i := 0; i < p.config.CmdTimeoutSeconds; i++ {
+		if pod, err := p.kubeClient.CoreV1().Pods(p.namespace).Get(ctx, helperPod.Name, metav1.GetOptions{}); err != nil {
+			if ctx.Err() == nil {
+				return err
+			}
+		} else if pod.Status.Phase == v1.PodSucceeded {
+			completed = true
+			break
+		} else if pod.Status.Phase == v1.PodFailed {
+			failure = helperFailureFailed
+			return fmt.Errorf("helper pod %v failed", helperPod.Name)
+		}
+		if !sleepOrDone(ctx, time.Second) {
+			abandoned = true
+			failure = helperFailureShutdown
+			return p.abandonHelperPod(helperPod.Name)
+		}
+	}
+	if !completed {
+		failure = helperFailureTimeout
+		return fmt.Errorf("create process timeout after %v seconds", p.config.CmdTimeoutSeconds)
+	}
+	if o.ModelCache && action == ActionTypeCreate {
+		logs, err := p.kubeClient.CoreV1().Pods(p.namespace).GetLogs(helperPod.Name, &v1.PodLogOptions{}).Do(ctx).Raw()
+		if kb, ok := modelPullSizeFromLogs(string(logs)); err == nil && ok {
+			modelPullBytes.WithLabelValues(o.Node).Add(float64(kb * 1024))
+		} else {
+			log.Warnf("unable to read the size of the model pulled by helper pod %v", helperPod.Name)
+		}
+	}
+
+	if o.Node == "" {
+		log.Infof("Volume %v has been %vd on %v", o.Name, action, o.Path)
+	} else {
+		log.Infof("Volume %v has been %vd on %v:%v", o.Name, action, o.Node, o.Path)
+	}
+	return nil
+}
+
+// modelPullSizeFromLogs returns the size in KiB printed by modelPullScript.
+func modelPullSizeFromLogs(logs string) (int64, bool) {
+	for _, line := range strings.Split(logs, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "pulled-kb" {
+			continue
+		}
+		if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return kb, true
+		}
+	}
+	return 0, false
+}
+
+// newVolumeHelperPod builds the helper pod running cmd, the setup or teardown
+// script, for the volume of o.
+func (p *LocalPathProvisioner) newVolumeHelperPod(action ActionType, cmd []string, o volumeOptions, annotation map[string]string) (*v1.Pod, error) {
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return nil, err
+	}
 	if o.Name == "" || o.Path == "" || (!sharedFS && o.Node == "") {
-		return fmt.Errorf("invalid empty name or path or node")
+		return nil, fmt.Errorf("invalid empty name or path or node")
 	}
 	if !filepath.IsAbs(o.Path) {
-		return fmt.Errorf("volume path %s is not absolute", o.Path)
+		return nil, fmt.Errorf("volume path %s is not absolute", o.Path)
 	}
 	o.Path = filepath.Clean(o.Path)
 	parentDir, volumeDir := filepath.Split(o.Path)
@@ -672,7 +1115,7 @@ func (p *LocalPathProvisioner) createHelperPod(action ActionType, cmd []string,
 	volumeDir = strings.TrimSuffix(volumeDir, string(filepath.Separator))
 	if parentDir == "" || volumeDir == "" || !filepath.IsAbs(parentDir) {
 		// it covers the `/` case
-		return fmt.Errorf("invalid path %v for %v: cannot find parent dir or volume dir or parent dir is relative", action, o.Path)
+		return nil, fmt.Errorf("invalid path %v for %v: cannot find parent dir or volume dir or parent dir is relative", action, o.Path)
 	}
 
 	env := []v1.EnvVar{
@@ -698,6 +1141,15 @@ func (p *LocalPathProvisioner) createHelperPod(action ActionType, cmd []string,
 		}
 		env = append(env, cacheEnv...)
 	}
+	if o.Permissions != nil {
+		env = append(env, o.Permissions.env()...)
+	}
+	if o.Mode == v1.PersistentVolumeBlock {
+		env = append(env,
+			v1.EnvVar{Name: envVolBlockImage, Value: filepath.Join(vol_dir, blockImageFile)},
+			v1.EnvVar{Name: envVolBlockDevice, Value: filepath.Join(vol_dir, blockDeviceFile)},
+		)
+	}
 
 	// use different name for helper pods
 	// https://github.com/rancher/local-path-provisioner/issues/154
@@ -715,6 +1167,11 @@ func (p *LocalPathProvisioner) createHelperPod(action ActionType, cmd []string,
 	helperPod.Spec.Tolerations = append(helperPod.Spec.Tolerations, lpvTolerations...)
 	helperPod.Spec.Volumes = append(helperPod.Spec.Volumes, lpvVolumes...)
 	helperPod.Spec.Containers[0].Command = cmd
+	if o.ModelCache && action == ActionTypeCreate {
+		// the pull reports the size of the model, no second helper pod
+		// measures it
+		helperPod.Spec.Containers[0].Command = []string{"/bin/sh", "-c", modelPullScript, "setup"}
+	}
 	helperPod.Spec.Containers[0].Env = append(helperPod.Spec.Containers[0].Env, env...)
 	helperPod.Spec.Containers[0].Args = []string{"-p", vol_dir,
 		"-s", strconv.FormatInt(o.SizeInBytes, 10),
@@ -725,55 +1182,7 @@ func (p *LocalPathProvisioner) createHelperPod(action ActionType, cmd []string,
 	if o.ModelCache {
 		helperPod.Spec.Containers[0].Image = p.helperImage
 	}
-
-	// If it already exists due to some previous errors, the pod will be cleaned up later automatically
-	// https://github.com/rancher/local-path-provisioner/issues/27
-	helperPodExists := false
-	_, err = p.kubeClient.CoreV1().Pods(p.namespace).Get(context.TODO(), helperPod.Name, metav1.GetOptions{})
-	if apierrors.IsNotFound(err) {
-		helperPodExists = false
-	} else if err != nil {
-		log.Fatalf("Error getting helperPod: %v", err)
-	} else {
-		helperPodExists = true
-		fmt.Printf("helperPod %s exists in namespace %s\n, skip create  helpPod", helperPod.Name, p.namespace)
-	}
-
-	if !helperPodExists {
-		logrus.Infof("create the helper pod %s into %s", helperPod.Name, p.namespace)
-		_, err = p.kubeClient.CoreV1().Pods(p.namespace).Create(context.TODO(), helperPod, metav1.CreateOptions{})
-		if err != nil && !k8serror.IsAlreadyExists(err) {
-			return err
-		}
-
-		defer func() {
-			e := p.kubeClient.CoreV1().Pods(p.namespace).Delete(context.TODO(), helperPod.Name, metav1.DeleteOptions{})
-			if e != nil {
-				logrus.Errorf("unable to delete the helper pod: %v", e)
-			}
-		}()
-	}
-
-	completed := false
-	for i := 0; i < p.config.CmdTimeoutSeconds; i++ {
-		if pod, err := p.kubeClient.CoreV1().Pods(p.namespace).Get(context.TODO(), helperPod.Name, metav1.GetOptions{}); err != nil {
-			return err
-		} else if pod.Status.Phase == v1.PodSucceeded {
-			completed = true
-			break
-		}
-		time.Sleep(1 * time.Second)
-	}
-	if !completed {
-		return fmt.Errorf("create process timeout after %v seconds", p.config.CmdTimeoutSeconds)
-	}
-
-	if o.Node == "" {
-		logrus.Infof("Volume %v has been %vd on %v", o.Name, action, o.Path)
-	} else {
-		logrus.Infof("Volume %v has been %vd on %v:%v", o.Name, action, o.Node, o.Path)
-	}
-	return nil
+	return helperPod, nil
 }
 
 func addVolumeMount(mounts *[]v1.VolumeMount, name, mountPath string) *v1.VolumeMount {
@@ -858,6 +1267,27 @@ func canonicalizeConfig(data *ConfigData) (cfg *Config, err error) {
 	} else {
 		cfg.CmdTimeoutSeconds = defaultCmdTimeoutSeconds
 	}
+	if data.TrashRetentionSeconds > 0 {
+		cfg.TrashRetentionSeconds = data.TrashRetentionSeconds
+	} else {
+		cfg.TrashRetentionSeconds = defaultTrashRetentionSeconds
+	}
+	if cfg.VolumeCatalog, err = canonicalizeCatalog(data.VolumeCatalog, data.SharedFileSystemPath != ""); err != nil {
+		return nil, err
+	}
+	if cfg.HelperConcurrency, err = canonicalizeHelperConcurrency(data.HelperConcurrency); err != nil {
+		return nil, err
+	}
+	if cfg.Quotas, err = canonicalizeQuotas(data.Quotas, data.SharedFileSystemPath != ""); err != nil {
+		return nil, err
+	}
+	if cfg.DeletedNodePolicy, err = canonicalizeDeletedNodePolicy(data.DeletedNodePolicy); err != nil {
+		return nil, err
+	}
+	if data.BlockVolumes && data.SharedFileSystemPath != "" {
+		return nil, fmt.Errorf("blockVolumes is not supported with sharedFileSystemPath")
+	}
+	cfg.BlockVolumes = data.BlockVolumes
 	return cfg, nil
 }
 
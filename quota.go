@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	// QuotaReservationTimeout is how long the capacity of a volume accepted by
+	// Provision counts towards the quotas while its PV is being created.
+	QuotaReservationTimeout = 1 * time.Minute
+)
+
+type QuotaData struct {
+	Name         string            `json:"name,omitempty"`
+	Namespace    string            `json:"namespace,omitempty"`
+	Nodes        []string          `json:"nodes,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Paths        []string          `json:"paths,omitempty"`
+	Capacity     string            `json:"capacity,omitempty"`
+	Volumes      int               `json:"volumes,omitempty"`
+}
+
+// Quota limits the capacity and the number of the volumes of a namespace on
+// the nodes and paths in its scope. An empty scope covers all of them.
+type Quota struct {
+	Name         string
+	Namespace    string
+	Nodes        map[string]struct{}
+	NodeSelector labels.Selector
+	Paths        map[string]struct{}
+	// nil when the capacity is not limited
+	Capacity *resource.Quantity
+	// 0 when the number of volumes is not limited
+	Volumes int
+}
+
+type quotaReservation struct {
+	namespace string
+	node      string
+	basePath  string
+	capacity  resource.Quantity
+	time      time.Time
+}
+
+func canonicalizeQuotas(data []*QuotaData, sharedFS bool) ([]*Quota, error) {
+	var quotas []*Quota
+	for i, q := range data {
+		name := q.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if q.Namespace == "" {
+			return nil, fmt.Errorf("quota %v has no namespace", name)
+		}
+		if sharedFS && (len(q.Nodes) > 0 || len(q.NodeSelector) > 0) {
+			return nil, fmt.Errorf("quota %v cannot be scoped to nodes with sharedFileSystemPath", name)
+		}
+		if q.Capacity == "" && q.Volumes <= 0 {
+			return nil, fmt.Errorf("quota %v limits neither capacity nor volumes", name)
+		}
+		quota := &Quota{
+			Name:      name,
+			Namespace: q.Namespace,
+			Volumes:   q.Volumes,
+		}
+		if len(q.Nodes) > 0 {
+			quota.Nodes = map[string]struct{}{}
+			for _, node := range q.Nodes {
+				quota.Nodes[node] = struct{}{}
+			}
+		}
+		if len(q.NodeSelector) > 0 {
+			quota.NodeSelector = labels.SelectorFromSet(q.NodeSelector)
+		}
+		if len(q.Paths) > 0 {
+			quota.Paths = map[string]struct{}{}
+			for _, path := range q.Paths {
+				if path == "" || path[0] != '/' {
+					return nil, fmt.Errorf("path must start with / for path %v of quota %v", path, name)
+				}
+				quota.Paths[filepath.Clean(path)] = struct{}{}
+			}
+		}
+		if q.Capacity != "" {
+			capacity, err := resource.ParseQuantity(q.Capacity)
+			if err != nil {
+				return nil, fmt.Errorf("invalid capacity %q for quota %v: %v", q.Capacity, name, err)
+			}
+			quota.Capacity = &capacity
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+// appliesTo returns whether a volume of namespace under basePath on node,
+// with nodeLabels, counts towards q.
+func (q *Quota) appliesTo(namespace, node string, nodeLabels labels.Set, basePath string) bool {
+	if namespace != q.Namespace {
+		return false
+	}
+	if q.Nodes != nil {
+		if _, ok := q.Nodes[node]; !ok {
+			return false
+		}
+	}
+	if q.NodeSelector != nil && !q.NodeSelector.Matches(nodeLabels) {
+		return false
+	}
+	if q.Paths != nil {
+		if _, ok := q.Paths[basePath]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scope describes the nodes and paths covered by q.
+func (q *Quota) scope() string {
+	var scope []string
+	if q.Nodes != nil {
+		var nodes []string
+		for node := range q.Nodes {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		scope = append(scope, "nodes "+strings.Join(nodes, ", "))
+	}
+	if q.NodeSelector != nil {
+		scope = append(scope, "nodes matching "+q.NodeSelector.String())
+	}
+	if q.Paths != nil {
+		var paths []string
+		for path := range q.Paths {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		scope = append(scope, "paths "+strings.Join(paths, ", "))
+	}
+	if len(scope) == 0 {
+		return "all nodes"
+	}
+	return strings.Join(scope, " and ")
+}
+
+// checkQuotas rejects volume pvName of claim pvc under basePath on node when
+// its capacity would exceed a quota, reporting the usage in an Event on the
+// claim. An accepted volume counts towards the quotas right away, until its
+// PV exists or releaseQuotaReservation is called.
+func (p *LocalPathProvisioner) checkQuotas(pvc *v1.PersistentVolumeClaim, pvName string, node *v1.Node, basePath string, capacity resource.Quantity) error {
+	nodeName := ""
+	var nodeLabels labels.Set
+	if node != nil {
+		nodeName, nodeLabels = node.Name, node.Labels
+	}
+
+	p.configMutex.RLock()
+	var quotas []*Quota
+	needNodeLabels := false
+	for _, q := range p.config.Quotas {
+		if q.appliesTo(pvc.Namespace, nodeName, nodeLabels, basePath) {
+			quotas = append(quotas, q)
+			needNodeLabels = needNodeLabels || q.NodeSelector != nil
+		}
+	}
+	p.configMutex.RUnlock()
+	if len(quotas) == 0 {
+		return nil
+	}
+
+	p.quotaMutex.Lock()
+	defer p.quotaMutex.Unlock()
+
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return err
+	}
+	labelsByNode := map[string]labels.Set{}
+	if needNodeLabels {
+		nodes, err := p.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes.Items {
+			labelsByNode[n.Name] = n.Labels
+		}
+	}
+
+	used := make([]resource.Quantity, len(quotas))
+	count := make([]int, len(quotas))
+	add := func(namespace, node, basePath string, capacity resource.Quantity) {
+		for i, q := range quotas {
+			if q.appliesTo(namespace, node, labelsByNode[node], basePath) {
+				used[i].Add(capacity)
+				count[i]++
+			}
+		}
+	}
+	existing := map[string]struct{}{}
+	for _, pv := range pvs {
+		existing[pv.Name] = struct{}{}
+		namespace, _ := pvClaim(pv)
+		if pv.Name == pvName || namespace != pvc.Namespace {
+			continue
+		}
+		path, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil {
+			continue
+		}
+		add(namespace, node, p.getBasePathForVolume(node, filepath.Clean(path)), pv.Spec.Capacity[v1.ResourceStorage])
+	}
+	for name, r := range p.quotaReservations {
+		if _, ok := existing[name]; ok || time.Since(r.time) >= QuotaReservationTimeout {
+			delete(p.quotaReservations, name)
+			continue
+		}
+		if name != pvName {
+			add(r.namespace, r.node, r.basePath, r.capacity)
+		}
+	}
+
+	for i, q := range quotas {
+		var exceeded string
+		if q.Capacity != nil {
+			total := used[i].DeepCopy()
+			total.Add(capacity)
+			if total.Cmp(*q.Capacity) > 0 {
+				exceeded = fmt.Sprintf("%v of %v used, %v requested", used[i].String(), q.Capacity.String(), capacity.String())
+			}
+		}
+		if q.Volumes > 0 && count[i]+1 > q.Volumes {
+			if exceeded != "" {
+				exceeded += ", "
+			}
+			exceeded += fmt.Sprintf("%v of %v volumes used", count[i], q.Volumes)
+		}
+		if exceeded != "" {
+			msg := fmt.Sprintf("quota %v of namespace %v on %v exceeded: %v", q.Name, q.Namespace, q.scope(), exceeded)
+			p.eventRecorder.Event(pvc, v1.EventTypeWarning, "QuotaExceeded", msg)
+			return fmt.Errorf("%v", msg)
+		}
+	}
+
+	p.quotaReservations[pvName] = quotaReservation{
+		namespace: pvc.Namespace,
+		node:      nodeName,
+		basePath:  basePath,
+		capacity:  capacity,
+		time:      time.Now(),
+	}
+	return nil
+}
+
+// releaseQuotaReservation stops counting volume pvName towards the quotas
+// when it could not be provisioned.
+func (p *LocalPathProvisioner) releaseQuotaReservation(pvName string) {
+	p.quotaMutex.Lock()
+	defer p.quotaMutex.Unlock()
+	delete(p.quotaReservations, pvName)
+}
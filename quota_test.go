@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+
+	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+)
+
+// newTestProvisioner returns a provisioner with config whose API server
+// answers the GET requests of the paths of objects with them.
+func newTestProvisioner(t *testing.T, config *Config, objects map[string]interface{}) *LocalPathProvisioner {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj, ok := objects[r.URL.Path]
+		if r.Method != http.MethodGet || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(server.Close)
+	kubeClient, err := clientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LocalPathProvisioner{
+		kubeClient:        kubeClient,
+		provisionerName:   "rancher.io/local-path",
+		eventRecorder:     record.NewFakeRecorder(100),
+		config:            config,
+		configMutex:       &sync.RWMutex{},
+		quotaMutex:        &sync.Mutex{},
+		quotaReservations: map[string]quotaReservation{},
+
+		catalogMutex:        &sync.Mutex{},
+		catalogReservations: map[string]catalogReservation{},
+	}
+}
+
+func newTestVolume(name, namespace, node, path, capacity string) v1.PersistentVolume {
+	return v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annProvisionedBy: "rancher.io/local-path"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: path},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: namespace, Name: name},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{{
+						MatchExpressions: []v1.NodeSelectorRequirement{{
+							Key:      KeyNode,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{node},
+						}},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func TestCanonicalizeQuotas(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []*QuotaData
+		sharedFS bool
+		want     []*Quota
+		wantErr  bool
+	}{
+		{
+			name: "no quotas",
+		},
+		{
+			name: "capacity and volumes",
+			data: []*QuotaData{{Name: "team-x", Namespace: "team-x", Capacity: "2Ti", Volumes: 50}},
+			want: []*Quota{{Name: "team-x", Namespace: "team-x", Volumes: 50}},
+		},
+		{
+			name: "unnamed quota is named after its index",
+			data: []*QuotaData{
+				{Namespace: "team-x", Volumes: 1},
+				{Namespace: "team-y", Volumes: 1},
+			},
+			want: []*Quota{
+				{Name: "#0", Namespace: "team-x", Volumes: 1},
+				{Name: "#1", Namespace: "team-y", Volumes: 1},
+			},
+		},
+		{
+			name:    "no namespace",
+			data:    []*QuotaData{{Volumes: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "no limit",
+			data:    []*QuotaData{{Namespace: "team-x"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid capacity",
+			data:    []*QuotaData{{Namespace: "team-x", Capacity: "lots"}},
+			wantErr: true,
+		},
+		{
+			name:    "relative path",
+			data:    []*QuotaData{{Namespace: "team-x", Volumes: 1, Paths: []string{"data"}}},
+			wantErr: true,
+		},
+		{
+			name:     "paths on a shared filesystem",
+			data:     []*QuotaData{{Namespace: "team-x", Volumes: 1, Paths: []string{"/data/"}}},
+			sharedFS: true,
+			want:     []*Quota{{Name: "#0", Namespace: "team-x", Volumes: 1}},
+		},
+		{
+			name:     "nodes on a shared filesystem",
+			data:     []*QuotaData{{Namespace: "team-x", Volumes: 1, Nodes: []string{"node-1"}}},
+			sharedFS: true,
+			wantErr:  true,
+		},
+		{
+			name:     "node selector on a shared filesystem",
+			data:     []*QuotaData{{Namespace: "team-x", Volumes: 1, NodeSelector: map[string]string{"pool": "gpu"}}},
+			sharedFS: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalizeQuotas(tt.data, tt.sharedFS)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("canonicalizeQuotas() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("canonicalizeQuotas() returned %v quotas, want %v", len(got), len(tt.want))
+			}
+			for i, q := range got {
+				if q.Name != tt.want[i].Name || q.Namespace != tt.want[i].Namespace || q.Volumes != tt.want[i].Volumes {
+					t.Errorf("quota %v = %+v, want %+v", i, q, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCanonicalizeQuotasScope(t *testing.T) {
+	quotas, err := canonicalizeQuotas([]*QuotaData{{
+		Namespace:    "team-x",
+		Nodes:        []string{"node-1"},
+		NodeSelector: map[string]string{"pool": "gpu"},
+		Paths:        []string{"/data1/"},
+		Capacity:     "1Ti",
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := quotas[0]
+	if q.Capacity == nil || q.Capacity.Cmp(resource.MustParse("1Ti")) != 0 {
+		t.Errorf("capacity = %v, want 1Ti", q.Capacity)
+	}
+	if _, ok := q.Paths["/data1"]; !ok {
+		t.Errorf("paths = %v, want the cleaned /data1", q.Paths)
+	}
+	if want := "nodes node-1 and nodes matching pool=gpu and paths /data1"; q.scope() != want {
+		t.Errorf("scope() = %q, want %q", q.scope(), want)
+	}
+	gpu := map[string]string{"pool": "gpu"}
+	tests := []struct {
+		namespace, node string
+		labels          map[string]string
+		basePath        string
+		want            bool
+	}{
+		{"team-x", "node-1", gpu, "/data1", true},
+		{"team-y", "node-1", gpu, "/data1", false},
+		{"team-x", "node-2", gpu, "/data1", false},
+		{"team-x", "node-1", nil, "/data1", false},
+		{"team-x", "node-1", gpu, "/data2", false},
+	}
+	for _, tt := range tests {
+		if got := q.appliesTo(tt.namespace, tt.node, tt.labels, tt.basePath); got != tt.want {
+			t.Errorf("appliesTo(%v, %v, %v, %v) = %v, want %v", tt.namespace, tt.node, tt.labels, tt.basePath, got, tt.want)
+		}
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	volumes := &v1.PersistentVolumeList{Items: []v1.PersistentVolume{
+		newTestVolume("pvc-1", "team-x", "node-1", "/data1/pvc-1_team-x_pvc-1", "600Gi"),
+		newTestVolume("pvc-2", "team-x", "node-1", "/data2/pvc-2_team-x_pvc-2", "300Gi"),
+		newTestVolume("pvc-3", "team-x", "node-2", "/data1/pvc-3_team-x_pvc-3", "500Gi"),
+		newTestVolume("pvc-4", "team-y", "node-1", "/data1/pvc-4_team-y_pvc-4", "1Ti"),
+	}}
+	tests := []struct {
+		name      string
+		quota     QuotaData
+		namespace string
+		node      string
+		basePath  string
+		capacity  string
+		reserved  map[string]quotaReservation
+		wantErr   bool
+	}{
+		{
+			name:      "other namespace",
+			quota:     QuotaData{Namespace: "team-y", Capacity: "1Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "1Ti",
+		},
+		{
+			name:      "capacity left",
+			quota:     QuotaData{Namespace: "team-x", Capacity: "2Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "600Gi",
+		},
+		{
+			name:      "capacity exceeded",
+			quota:     QuotaData{Namespace: "team-x", Capacity: "2Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "700Gi",
+			wantErr: true,
+		},
+		{
+			name:      "capacity exceeded on the node only",
+			quota:     QuotaData{Namespace: "team-x", Nodes: []string{"node-1"}, Capacity: "1Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "200Gi",
+			wantErr: true,
+		},
+		{
+			name:      "capacity left on the path",
+			quota:     QuotaData{Namespace: "team-x", Paths: []string{"/data2"}, Capacity: "500Gi"},
+			namespace: "team-x", node: "node-1", basePath: "/data2", capacity: "200Gi",
+		},
+		{
+			name:      "volumes exceeded",
+			quota:     QuotaData{Namespace: "team-x", Volumes: 3},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "1Gi",
+			wantErr: true,
+		},
+		{
+			name:      "reservation counts",
+			quota:     QuotaData{Namespace: "team-x", Capacity: "2Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "100Gi",
+			reserved: map[string]quotaReservation{"pvc-5": {
+				namespace: "team-x", node: "node-1", basePath: "/data1",
+				capacity: resource.MustParse("600Gi"), time: time.Now(),
+			}},
+			wantErr: true,
+		},
+		{
+			name:      "expired reservation",
+			quota:     QuotaData{Namespace: "team-x", Capacity: "2Ti"},
+			namespace: "team-x", node: "node-1", basePath: "/data1", capacity: "100Gi",
+			reserved: map[string]quotaReservation{"pvc-5": {
+				namespace: "team-x", node: "node-1", basePath: "/data1",
+				capacity: resource.MustParse("600Gi"), time: time.Now().Add(-QuotaReservationTimeout),
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas, err := canonicalizeQuotas([]*QuotaData{&tt.quota}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{
+				NodePathMap: map[string]*NodePathMap{
+					NodeDefaultNonListedNodes: {Paths: map[string]struct{}{"/data1": {}, "/data2": {}}},
+				},
+				Quotas: quotas,
+			}
+			p := newTestProvisioner(t, config, map[string]interface{}{"/api/v1/persistentvolumes": volumes})
+			for name, r := range tt.reserved {
+				p.quotaReservations[name] = r
+			}
+			pvc := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "new"}}
+			node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: tt.node}}
+			err = p.checkQuotas(pvc, "pvc-new", node, tt.basePath, resource.MustParse(tt.capacity))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkQuotas() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// only volumes accepted by a quota are reserved
+			wantReserved := !tt.wantErr && tt.quota.Namespace == tt.namespace
+			if _, reserved := p.quotaReservations["pvc-new"]; reserved != wantReserved {
+				t.Errorf("reservation of the new volume = %v, want %v", reserved, wantReserved)
+			}
+		})
+	}
+}
+
+func TestProvisionFromCatalogQuota(t *testing.T) {
+	volumes := &v1.PersistentVolumeList{Items: []v1.PersistentVolume{
+		newTestVolume("pvc-1", "team-x", "node-1", "/data1/pvc-1_team-x_pvc-1", "600Gi"),
+	}}
+	catalog, err := canonicalizeCatalog([]*CatalogVolumeData{{
+		Name:     "dataset",
+		Node:     "node-1",
+		Path:     "/data1/dataset",
+		Capacity: "500Gi",
+		Labels:   map[string]string{"dataset": "imagenet"},
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		quota   QuotaData
+		wantErr bool
+	}{
+		{
+			name:  "capacity left",
+			quota: QuotaData{Namespace: "team-x", Capacity: "2Ti"},
+		},
+		{
+			name:    "capacity exceeded",
+			quota:   QuotaData{Namespace: "team-x", Paths: []string{"/data1"}, Capacity: "1Ti"},
+			wantErr: true,
+		},
+		{
+			name:    "volumes exceeded",
+			quota:   QuotaData{Namespace: "team-x", Nodes: []string{"node-1"}, Volumes: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas, err := canonicalizeQuotas([]*QuotaData{&tt.quota}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{
+				NodePathMap: map[string]*NodePathMap{
+					NodeDefaultNonListedNodes: {Paths: map[string]struct{}{"/data1": {}}},
+				},
+				VolumeCatalog: catalog,
+				Quotas:        quotas,
+			}
+			p := newTestProvisioner(t, config, map[string]interface{}{"/api/v1/persistentvolumes": volumes})
+			reclaimPolicy := v1.PersistentVolumeReclaimRetain
+			opts := pvController.ProvisionOptions{
+				PVName: "pvc-new",
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "team-x", Name: "new"},
+					Spec: v1.PersistentVolumeClaimSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"dataset": "imagenet"}},
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("100Gi")},
+						},
+					},
+				},
+				StorageClass: &storagev1.StorageClass{ReclaimPolicy: &reclaimPolicy},
+				SelectedNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			}
+			pv, _, err := p.provisionFromCatalog(opts, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provisionFromCatalog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && pv.Spec.HostPath.Path != "/data1/dataset" {
+				t.Errorf("provisionFromCatalog() bound %v, want /data1/dataset", pv.Spec.HostPath.Path)
+			}
+			// a rejected claim leaves the catalog volume free
+			if _, reserved := p.catalogReservations["dataset"]; reserved == tt.wantErr {
+				t.Errorf("reservation of the catalog volume = %v, want %v", reserved, !tt.wantErr)
+			}
+			if _, reserved := p.quotaReservations["pvc-new"]; reserved == tt.wantErr {
+				t.Errorf("quota reservation of the new volume = %v, want %v", reserved, !tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ActionTypeScan    = "scan"
+	ActionTypeCleanup = "cleanup"
+
+	// orphanMinAge is how long a directory without PV is left alone before
+	// it is reported, Provision creates the PV only once it is populated
+	orphanMinAge = time.Hour
+
+	// scanScript prints the modification time and the path of every entry of
+	// the configured paths given before "--", and reports the volume
+	// directories given after it which do not exist
+	scanScript = `set -u
+check=false
+for arg in "$@"; do
+    if [ "$arg" = "--" ]; then
+        check=true
+        continue
+    fi
+    if $check; then
+        [ -e "$arg" ] || echo "missing $arg"
+        continue
+    fi
+    [ -d "$arg" ] || continue
+    for entry in "$arg"/*; do
+        [ -e "$entry" ] || continue
+        echo "entry $(stat -c %Y "$entry") $entry"
+    done
+done`
+
+	// cleanupScript removes every orphan directory passed as argument
+	cleanupScript = `set -eu
+for dir in "$@"; do
+    echo "removing $dir"
+    rm -rf "$dir"
+done`
+)
+
+// ReconcileReport lists the differences between the PVs of the provisioner
+// and the directories on disk.
+type ReconcileReport struct {
+	Time           time.Time         `json:"time"`
+	MissingVolumes []MissingVolume   `json:"missingVolumes"`
+	Orphans        []OrphanDirectory `json:"orphans"`
+}
+
+// MissingVolume is a PV whose directory does not exist.
+type MissingVolume struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Claim     string `json:"claim,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Path      string `json:"path"`
+}
+
+// OrphanDirectory is a volume directory of a configured path which no PV
+// uses.
+type OrphanDirectory struct {
+	Node     string    `json:"node,omitempty"`
+	Path     string    `json:"path"`
+	Modified time.Time `json:"modified"`
+}
+
+var (
+	// volumeDirPattern matches the <pv name>_<namespace>_<claim> directories
+	// created by Provision
+	volumeDirPattern = regexp.MustCompile(`^pvc-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}_[^_]+_.+$`)
+)
+
+type nodeScan struct {
+	entries map[string]time.Time
+	missing map[string]bool
+}
+
+// reconcile compares the PVs with the directories under every configured
+// path, one helper pod per node.
+func (p *LocalPathProvisioner) reconcile() (*ReconcileReport, error) {
+	pathsByNode, err := p.getPathsByNode()
+	if err != nil {
+		return nil, err
+	}
+	pvList, err := p.kubeClient.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// directories of foreign PVs and of the catalog are never orphans,
+	// wherever they are
+	inUse := map[string]bool{}
+	p.configMutex.RLock()
+	for _, v := range p.config.VolumeCatalog {
+		inUse[v.Path] = true
+	}
+	p.configMutex.RUnlock()
+
+	volumesByNode := map[string]map[string]*v1.PersistentVolume{}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		path, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil {
+			continue
+		}
+		inUse[path] = true
+		if pv.Annotations[annProvisionedBy] != p.provisionerName {
+			continue
+		}
+		if volumesByNode[node] == nil {
+			volumesByNode[node] = map[string]*v1.PersistentVolume{}
+		}
+		volumesByNode[node][path] = pv
+	}
+
+	cutoff := time.Now().Add(-orphanMinAge)
+	report := &ReconcileReport{
+		Time:           time.Now().UTC(),
+		MissingVolumes: []MissingVolume{},
+		Orphans:        []OrphanDirectory{},
+	}
+	nodes := map[string]struct{}{}
+	for node := range pathsByNode {
+		nodes[node] = struct{}{}
+	}
+	for node := range volumesByNode {
+		nodes[node] = struct{}{}
+	}
+	for node := range nodes {
+		var volumePaths []string
+		for path := range volumesByNode[node] {
+			volumePaths = append(volumePaths, path)
+		}
+		sort.Strings(volumePaths)
+		scan, err := p.scanNode(node, pathsByNode[node], volumePaths)
+		if err != nil {
+			// the other nodes are still worth reporting, and nothing of
+			// this node can be found orphan
+			logrus.Errorf("failed to scan node %v: %v", node, err)
+			continue
+		}
+		for _, path := range volumePaths {
+			if !scan.missing[path] {
+				continue
+			}
+			pv := volumesByNode[node][path]
+			missing := MissingVolume{Name: pv.Name, Node: node, Path: path}
+			if pv.Spec.ClaimRef != nil {
+				missing.Namespace, missing.Claim = pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+			}
+			report.MissingVolumes = append(report.MissingVolumes, missing)
+		}
+		for entry, modified := range scan.entries {
+			if isEntryInUse(entry, inUse) {
+				continue
+			}
+			// entries of other tools, e.g. lost+found of a mount point, are
+			// not ours to report or remove
+			if !volumeDirPattern.MatchString(filepath.Base(entry)) {
+				logrus.Debugf("skip %v:%v which was not created by the provisioner", node, entry)
+				continue
+			}
+			if modified.After(cutoff) {
+				logrus.Debugf("skip %v:%v which may belong to a volume being provisioned", node, entry)
+				continue
+			}
+			report.Orphans = append(report.Orphans, OrphanDirectory{Node: node, Path: entry, Modified: modified})
+		}
+	}
+	sort.Slice(report.MissingVolumes, func(i, j int) bool {
+		return report.MissingVolumes[i].Name < report.MissingVolumes[j].Name
+	})
+	sort.Slice(report.Orphans, func(i, j int) bool {
+		if report.Orphans[i].Node != report.Orphans[j].Node {
+			return report.Orphans[i].Node < report.Orphans[j].Node
+		}
+		return report.Orphans[i].Path < report.Orphans[j].Path
+	})
+	return report, nil
+}
+
+// isEntryInUse tells whether a volume directory is entry or lies below it,
+// e.g. with a pathPattern.
+func isEntryInUse(entry string, inUse map[string]bool) bool {
+	if inUse[entry] {
+		return true
+	}
+	for path := range inUse {
+		if strings.HasPrefix(path, entry+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanNode lists the entries of basePaths on node and checks which of
+// volumePaths are missing. The directories are mounted read-only and only if
+// they exist, a missing base path has no entries and the volumes under a
+// missing directory are missing.
+func (p *LocalPathProvisioner) scanNode(node string, basePaths, volumePaths []string) (*nodeScan, error) {
+	scan := &nodeScan{
+		entries: map[string]time.Time{},
+		missing: map[string]bool{},
+	}
+	for len(basePaths)+len(volumePaths) > 0 {
+		dirs := map[string]struct{}{}
+		for _, path := range basePaths {
+			dirs[path] = struct{}{}
+		}
+		for _, path := range volumePaths {
+			dirs[filepath.Dir(path)] = struct{}{}
+		}
+		var mounts []string
+		for dir := range dirs {
+			mounts = append(mounts, dir)
+		}
+		sort.Strings(mounts)
+
+		args := append(append(append([]string{}, basePaths...), "--"), volumePaths...)
+		helperPod := p.newNodeHelperPod(ActionTypeScan, node, readOnlyMounts(mounts...), scanScript, args)
+		output, err := p.runHelperPod(helperPod)
+		mountErr, ok := err.(*helperMountError)
+		if !ok {
+			if err != nil {
+				return nil, err
+			}
+			scan.parse(output)
+			break
+		}
+		missingDirs := map[string]bool{}
+		for _, dir := range mountErr.dirs {
+			missingDirs[dir] = true
+		}
+		var remainingBase, remainingVolumes []string
+		for _, path := range basePaths {
+			if !missingDirs[path] {
+				remainingBase = append(remainingBase, path)
+			}
+		}
+		for _, path := range volumePaths {
+			if missingDirs[filepath.Dir(path)] {
+				scan.missing[path] = true
+			} else {
+				remainingVolumes = append(remainingVolumes, path)
+			}
+		}
+		if len(remainingBase)+len(remainingVolumes) == len(basePaths)+len(volumePaths) {
+			return nil, err
+		}
+		basePaths, volumePaths = remainingBase, remainingVolumes
+	}
+	return scan, nil
+}
+
+// parse reads the output of scanScript.
+func (scan *nodeScan) parse(output string) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		switch {
+		case len(fields) >= 2 && fields[0] == "missing":
+			scan.missing[strings.TrimPrefix(line, "missing ")] = true
+		case len(fields) == 3 && fields[0] == "entry":
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			scan.entries[fields[2]] = time.Unix(seconds, 0).UTC()
+		}
+	}
+}
+
+// removeOrphans removes the given orphan directories, one helper pod per
+// node. Only the directories which are still orphans in a fresh scan are
+// removed, anything provisioned meanwhile is kept.
+func (p *LocalPathProvisioner) removeOrphans(orphans []OrphanDirectory) ([]OrphanDirectory, error) {
+	report, err := p.reconcile()
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]bool{}
+	for _, o := range report.Orphans {
+		current[o.Node+":"+o.Path] = true
+	}
+
+	byNode := map[string][]string{}
+	var removed []OrphanDirectory
+	for _, o := range orphans {
+		if !current[o.Node+":"+o.Path] {
+			logrus.Infof("Keeping %v:%v which is no longer an orphan", o.Node, o.Path)
+			continue
+		}
+		byNode[o.Node] = append(byNode[o.Node], o.Path)
+		removed = append(removed, o)
+	}
+	for node, paths := range byNode {
+		parents := map[string]struct{}{}
+		for _, path := range paths {
+			parents[filepath.Dir(path)] = struct{}{}
+		}
+		var mounts []string
+		for dir := range parents {
+			mounts = append(mounts, dir)
+		}
+		sort.Strings(mounts)
+		helperPod := p.newNodeHelperPod(ActionTypeCleanup, node, existingMounts(mounts...), cleanupScript, paths)
+		if _, err := p.runHelperPod(helperPod); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove orphans on node %v", node)
+		}
+	}
+	return removed, nil
+}
+
+// logReconcileReport logs the findings of a reconciliation pass.
+func logReconcileReport(report *ReconcileReport) {
+	for _, m := range report.MissingVolumes {
+		logrus.Warnf("Directory %v of volume %v is missing on node %v", m.Path, m.Name, m.Node)
+	}
+	for _, o := range report.Orphans {
+		logrus.Warnf("Directory %v on node %v has no volume", o.Path, o.Node)
+	}
+	logrus.Infof("Reconciliation found %d missing volume directories and %d orphan directories",
+		len(report.MissingVolumes), len(report.Orphans))
+}
+
+func printReconcileReport(w io.Writer, report *ReconcileReport, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	fmt.Fprintf(w, "Missing volume directories: %d\n", len(report.MissingVolumes))
+	for _, m := range report.MissingVolumes {
+		fmt.Fprintf(w, "  %v\t%v/%v\t%v:%v\n", m.Name, m.Namespace, m.Claim, m.Node, m.Path)
+	}
+	fmt.Fprintf(w, "Orphan directories: %d\n", len(report.Orphans))
+	for _, o := range report.Orphans {
+		fmt.Fprintf(w, "  %v:%v\tmodified %v\n", o.Node, o.Path, o.Modified.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func ReconcileCmd() cli.Command {
+	return cli.Command{
+		Name:  "reconcile",
+		Usage: "Compare the PVs of the provisioner with the directories on disk",
+		Flags: append(provisionerFlags(),
+			cli.StringFlag{
+				Name:  FlagFormat,
+				Usage: "Output format of the report, text or json. The json report can be passed to reconcile cleanup.",
+				Value: "text",
+			},
+		),
+		Action: func(c *cli.Context) {
+			if err := runReconcile(c); err != nil {
+				logrus.Fatalf("Error reconciling volumes: %v", err)
+			}
+		},
+		Subcommands: []cli.Command{
+			{
+				Name:  "cleanup",
+				Usage: "Remove the orphan directories of a json report",
+				Flags: append(provisionerFlags(),
+					cli.StringFlag{
+						Name:  FlagReport,
+						Usage: "Required. The json report of reconcile, - reads it from stdin.",
+					},
+					cli.BoolFlag{
+						Name:  FlagConfirm,
+						Usage: "Required to actually remove the directories.",
+					},
+				),
+				Action: func(c *cli.Context) {
+					if err := runReconcileCleanup(c); err != nil {
+						logrus.Fatalf("Error cleaning up orphans: %v", err)
+					}
+				},
+			},
+		},
+	}
+}
+
+func runReconcile(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	format := c.String(FlagFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid flag %v %q, must be text or json", FlagFormat, format)
+	}
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	report, err := p.reconcile()
+	if err != nil {
+		return err
+	}
+	return printReconcileReport(os.Stdout, report, format)
+}
+
+func runReconcileCleanup(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	reportFile := c.String(FlagReport)
+	if reportFile == "" {
+		return fmt.Errorf("invalid empty flag %v", FlagReport)
+	}
+	var r io.Reader = os.Stdin
+	if reportFile != "-" {
+		f, err := os.Open(reportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	report := &ReconcileReport{}
+	if err := json.NewDecoder(r).Decode(report); err != nil {
+		return errors.Wrapf(err, "invalid report %v", reportFile)
+	}
+	if !c.Bool(FlagConfirm) {
+		for _, o := range report.Orphans {
+			fmt.Printf("would remove %v:%v\n", o.Node, o.Path)
+		}
+		return fmt.Errorf("nothing removed, pass --%v to remove %d directories", FlagConfirm, len(report.Orphans))
+	}
+
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	removed, err := p.removeOrphans(report.Orphans)
+	if err != nil {
+		return err
+	}
+	for _, o := range removed {
+		fmt.Printf("removed %v:%v\n", o.Node, o.Path)
+	}
+	return nil
+}
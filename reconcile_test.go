@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsEntryInUse(t *testing.T) {
+	inUse := map[string]bool{
+		"/opt/local-path-provisioner/pvc-1_default_data":      true,
+		"/opt/local-path-provisioner/models/llama/pvc-2_ml_x": true,
+	}
+	tests := []struct {
+		entry string
+		want  bool
+	}{
+		{"/opt/local-path-provisioner/pvc-1_default_data", true},
+		// a pathPattern places volumes below the entry
+		{"/opt/local-path-provisioner/models", true},
+		{"/opt/local-path-provisioner/models/llama", true},
+		{"/opt/local-path-provisioner/model", false},
+		{"/opt/local-path-provisioner/pvc-1_default", false},
+		{"/opt/local-path-provisioner/pvc-3_default_data", false},
+	}
+	for _, tt := range tests {
+		if got := isEntryInUse(tt.entry, inUse); got != tt.want {
+			t.Errorf("isEntryInUse(%v) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestNodeScanParse(t *testing.T) {
+	scan := &nodeScan{entries: map[string]time.Time{}, missing: map[string]bool{}}
+	scan.parse("entry 1700000000 /opt/local-path-provisioner/pvc-1_default_data\n" +
+		"entry 1700000060 /opt/local-path-provisioner/with space\n" +
+		"missing /opt/local-path-provisioner/pvc-2_default_logs\n" +
+		"entry later /opt/local-path-provisioner/pvc-3_default_tmp\n" +
+		"+ set -x trace\n")
+
+	wantEntries := map[string]time.Time{
+		"/opt/local-path-provisioner/pvc-1_default_data": time.Unix(1700000000, 0).UTC(),
+		"/opt/local-path-provisioner/with space":         time.Unix(1700000060, 0).UTC(),
+	}
+	if len(scan.entries) != len(wantEntries) {
+		t.Errorf("entries = %v, want %v", scan.entries, wantEntries)
+	}
+	for entry, modified := range wantEntries {
+		if got, ok := scan.entries[entry]; !ok || !got.Equal(modified) {
+			t.Errorf("entry %v modified at %v, want %v", entry, got, modified)
+		}
+	}
+	if len(scan.missing) != 1 || !scan.missing["/opt/local-path-provisioner/pvc-2_default_logs"] {
+		t.Errorf("missing = %v, want only pvc-2_default_logs", scan.missing)
+	}
+}
+
+func TestVolumeDirPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"pvc-2d4e6b1a-0c6f-4d6e-9a3b-5f1e2d3c4b5a_default_data", true},
+		// the claim is whatever follows the namespace
+		{"pvc-2d4e6b1a-0c6f-4d6e-9a3b-5f1e2d3c4b5a_default_my_data", true},
+		{"pvc-2d4e6b1a-0c6f-4d6e-9a3b-5f1e2d3c4b5a_default_", false},
+		{"pvc-2d4e6b1a-0c6f-4d6e-9a3b-5f1e2d3c4b5a", false},
+		{"pvc-2D4E6B1A-0C6F-4D6E-9A3B-5F1E2D3C4B5A_default_data", false},
+		{"pvc-2d4e6b1a_default_data", false},
+		{"lost+found", false},
+		{".trash", false},
+		{".snapshots", false},
+		{"models", false},
+	}
+	for _, tt := range tests {
+		if got := volumeDirPattern.MatchString(tt.name); got != tt.want {
+			t.Errorf("volumeDirPattern.MatchString(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// AnnotationResumable marks a helper pod left running at shutdown, the
+	// next instance waits for it or takes its result instead of starting over
+	AnnotationResumable = "local.path.provisioner/resumable"
+
+	// unwindTimeout is how long the operations get to return once they
+	// stopped waiting for their helper pods
+	unwindTimeout = 5 * time.Second
+)
+
+// sleepOrDone waits for d and returns false when ctx is done before.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// abandonHelperPod stops waiting for a helper pod at shutdown, leaving it to
+// run to completion and marking it for the next instance.
+func (p *LocalPathProvisioner) abandonHelperPod(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), unwindTimeout)
+	defer cancel()
+	patch, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]string{AnnotationResumable: "true"}}})
+	if _, err := p.kubeClient.CoreV1().Pods(p.namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		logrus.WithField(logFieldHelperPod, name).Errorf("failed to mark the helper pod %v as resumable: %v", name, err)
+	}
+	return fmt.Errorf("shutting down, left helper pod %v running for the next instance", name)
+}
+
+// drain waits up to gracePeriod for the operations in flight once no new work
+// is taken, then stops waiting for the helper pods still running. Those are
+// left to finish on their own and are picked up by the next instance.
+func (p *LocalPathProvisioner) drain(gracePeriod time.Duration) {
+	if n := p.operations.count(); n > 0 {
+		logrus.Infof("Waiting up to %v for %v operations of %v in flight", gracePeriod, n, p.provisionerName)
+	}
+	deadline := time.Now().Add(gracePeriod)
+	for p.operations.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := p.operations.count(); n > 0 {
+		logrus.Warnf("Leaving %v operations of %v in flight to the next instance", n, p.provisionerName)
+	}
+	p.stopHelpers()
+
+	deadline = time.Now().Add(unwindTimeout)
+	for p.operations.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// drainAll drains provisioners side by side, within a single grace period.
+func drainAll(provisioners []*LocalPathProvisioner, gracePeriod time.Duration) {
+	var wg sync.WaitGroup
+	for _, p := range provisioners {
+		wg.Add(1)
+		go func(p *LocalPathProvisioner) {
+			defer wg.Done()
+			p.drain(gracePeriod)
+		}(p)
+	}
+	wg.Wait()
+}
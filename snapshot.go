@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	SnapshotGroup           = "local.path.provisioner"
+	KindLocalVolumeSnapshot = "LocalVolumeSnapshot"
+
+	snapshotFinalizer = "local.path.provisioner/snapshot-protection"
+	snapshotDirName   = ".snapshots"
+)
+
+var (
+	SnapshotSyncInterval = 10 * time.Second
+
+	// a snapshot whose copy failed is retried after SnapshotSyncInterval,
+	// doubled on every failure up to snapshotMaxBackoff, and marked failed
+	// for good after snapshotMaxAttempts
+	snapshotMaxBackoff  = 10 * time.Minute
+	snapshotMaxAttempts = 8
+
+	localVolumeSnapshotResource = schema.GroupVersionResource{
+		Group:    SnapshotGroup,
+		Version:  "v1alpha1",
+		Resource: "localvolumesnapshots",
+	}
+)
+
+// LocalVolumeSnapshot is a point-in-time copy of the directory of a volume,
+// kept in a snapshot area next to the volume on the same node.
+type LocalVolumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LocalVolumeSnapshotSpec   `json:"spec"`
+	Status LocalVolumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type LocalVolumeSnapshotSpec struct {
+	PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+}
+
+type LocalVolumeSnapshotStatus struct {
+	ReadyToUse   bool               `json:"readyToUse,omitempty"`
+	SourceVolume string             `json:"sourceVolume,omitempty"`
+	Node         string             `json:"node,omitempty"`
+	Path         string             `json:"path,omitempty"`
+	RestoreSize  *resource.Quantity `json:"restoreSize,omitempty"`
+	CreationTime *metav1.Time       `json:"creationTime,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	// FailedAttempts counts the copies which failed so far, the last one at
+	// LastFailureTime
+	FailedAttempts  int          `json:"failedAttempts,omitempty"`
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+}
+
+// snapshotBackoff returns how long to wait after the last of attempts failed
+// copies before the next one.
+func snapshotBackoff(attempts int) time.Duration {
+	backoff := SnapshotSyncInterval
+	for i := 1; i < attempts && backoff < snapshotMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > snapshotMaxBackoff {
+		backoff = snapshotMaxBackoff
+	}
+	return backoff
+}
+
+func (p *LocalPathProvisioner) getSnapshot(namespace, name string) (*LocalVolumeSnapshot, error) {
+	obj, err := p.dynamicClient.Resource(localVolumeSnapshotResource).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFromUnstructured(obj)
+}
+
+func snapshotFromUnstructured(obj *unstructured.Unstructured) (*LocalVolumeSnapshot, error) {
+	snap := &LocalVolumeSnapshot{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func snapshotToUnstructured(snap *LocalVolumeSnapshot) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+func snapshotReference(snap *LocalVolumeSnapshot) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		APIVersion: localVolumeSnapshotResource.GroupVersion().String(),
+		Kind:       KindLocalVolumeSnapshot,
+		Namespace:  snap.Namespace,
+		Name:       snap.Name,
+		UID:        snap.UID,
+	}
+}
+
+func (p *LocalPathProvisioner) updateSnapshot(snap *LocalVolumeSnapshot, status bool) (*LocalVolumeSnapshot, error) {
+	obj, err := snapshotToUnstructured(snap)
+	if err != nil {
+		return nil, err
+	}
+	client := p.dynamicClient.Resource(localVolumeSnapshotResource).Namespace(snap.Namespace)
+	if status {
+		obj, err = client.UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+	} else {
+		obj, err = client.Update(context.TODO(), obj, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFromUnstructured(obj)
+}
+
+func (p *LocalPathProvisioner) watchAndSyncSnapshots() {
+	go func() {
+		ticker := time.NewTicker(SnapshotSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.syncSnapshots(); err != nil {
+					logrus.Errorf("failed to sync volume snapshots: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop syncing volume snapshots")
+				return
+			}
+		}
+	}()
+}
+
+func (p *LocalPathProvisioner) syncSnapshots() error {
+	list, err := p.dynamicClient.Resource(localVolumeSnapshotResource).Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		snap, err := snapshotFromUnstructured(&list.Items[i])
+		if err != nil {
+			logrus.Errorf("invalid volume snapshot %v/%v: %v", list.Items[i].GetNamespace(), list.Items[i].GetName(), err)
+			continue
+		}
+		if err := p.syncSnapshot(snap); err != nil {
+			logrus.Errorf("failed to sync volume snapshot %v/%v: %v", snap.Namespace, snap.Name, err)
+		}
+	}
+	return nil
+}
+
+func hasFinalizer(finalizers []string, finalizer string) bool {
+	for _, f := range finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	var result []string
+	for _, f := range finalizers {
+		if f != finalizer {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func (p *LocalPathProvisioner) syncSnapshot(snap *LocalVolumeSnapshot) error {
+	if snap.DeletionTimestamp != nil {
+		return p.deleteSnapshot(snap)
+	}
+	if snap.Status.ReadyToUse || snap.Status.Error != "" {
+		return nil
+	}
+	if last := snap.Status.LastFailureTime; last != nil && time.Since(last.Time) < snapshotBackoff(snap.Status.FailedAttempts) {
+		return nil
+	}
+
+	pvc, err := p.kubeClient.CoreV1().PersistentVolumeClaims(snap.Namespace).Get(context.TODO(), snap.Spec.PersistentVolumeClaimName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pvc.Spec.VolumeName == "" {
+		return fmt.Errorf("claim %v/%v is not bound yet", pvc.Namespace, pvc.Name)
+	}
+	pv, err := p.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Annotations[annProvisionedBy] != p.provisionerName {
+		// the volume belongs to another provisioner
+		return nil
+	}
+
+	if isBlockVolume(pv) {
+		return p.failSnapshot(snap, fmt.Errorf("block volume %v cannot be snapshotted", pv.Name))
+	}
+	path, node, err := p.getPathAndNodeForPV(pv)
+	if err != nil {
+		return p.failSnapshot(snap, err)
+	}
+
+	if !hasFinalizer(snap.Finalizers, snapshotFinalizer) {
+		snap.Finalizers = append(snap.Finalizers, snapshotFinalizer)
+		if snap, err = p.updateSnapshot(snap, false); err != nil {
+			return err
+		}
+	}
+
+	snapshotPath := filepath.Join(p.getBasePathForVolume(node, path), snapshotDirName,
+		fmt.Sprintf("%s_%s_%s", snap.Namespace, snap.Name, snap.UID))
+	logrus.Infof("Creating snapshot %v/%v of volume %v at %v:%v", snap.Namespace, snap.Name, pv.Name, node, snapshotPath)
+	if err := p.copyVolumeData(node, path, snapshotPath); err != nil {
+		return p.retrySnapshot(snap, errors.Wrapf(err, "failed to snapshot volume %v", pv.Name))
+	}
+
+	now := metav1.Now()
+	storage := pv.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	snap.Status = LocalVolumeSnapshotStatus{
+		ReadyToUse:     true,
+		SourceVolume:   pv.Name,
+		Node:           node,
+		Path:           snapshotPath,
+		RestoreSize:    &storage,
+		CreationTime:   &now,
+		FailedAttempts: snap.Status.FailedAttempts,
+	}
+	if _, err := p.updateSnapshot(snap, true); err != nil {
+		return err
+	}
+	p.eventRecorder.Eventf(snapshotReference(snap), v1.EventTypeNormal, "SnapshotCreated", "snapshot of volume %v is ready to use", pv.Name)
+	return nil
+}
+
+// failSnapshot records an error which retrying cannot fix on the snapshot.
+func (p *LocalPathProvisioner) failSnapshot(snap *LocalVolumeSnapshot, cause error) error {
+	p.eventRecorder.Eventf(snapshotReference(snap), v1.EventTypeWarning, "SnapshotFailed", "%v", cause)
+	snap.Status.Error = cause.Error()
+	_, err := p.updateSnapshot(snap, true)
+	return err
+}
+
+// retrySnapshot records a failed copy on the snapshot, which is retried
+// after snapshotBackoff until snapshotMaxAttempts copies failed.
+func (p *LocalPathProvisioner) retrySnapshot(snap *LocalVolumeSnapshot, cause error) error {
+	attempts := snap.Status.FailedAttempts + 1
+	if attempts >= snapshotMaxAttempts {
+		snap.Status.FailedAttempts = attempts
+		return p.failSnapshot(snap, errors.Wrapf(cause, "giving up after %v attempts", attempts))
+	}
+	p.eventRecorder.Eventf(snapshotReference(snap), v1.EventTypeWarning, "SnapshotFailed", "%v, retrying in %v", cause, snapshotBackoff(attempts))
+	now := metav1.Now()
+	snap.Status.FailedAttempts = attempts
+	snap.Status.LastFailureTime = &now
+	if _, err := p.updateSnapshot(snap, true); err != nil {
+		return err
+	}
+	return cause
+}
+
+func (p *LocalPathProvisioner) deleteSnapshot(snap *LocalVolumeSnapshot) error {
+	if !hasFinalizer(snap.Finalizers, snapshotFinalizer) {
+		return nil
+	}
+	if snap.Status.Path != "" {
+		logrus.Infof("Deleting snapshot %v/%v at %v:%v", snap.Namespace, snap.Name, snap.Status.Node, snap.Status.Path)
+		helperPod := p.newNodeHelperPod(ActionTypeDelete, snap.Status.Node, createMounts(filepath.Dir(snap.Status.Path)),
+			`set -eu; rm -rf "$1"`, []string{snap.Status.Path})
+		if _, err := p.runHelperPod(helperPod); err != nil {
+			return errors.Wrapf(err, "failed to delete snapshot directory %v", snap.Status.Path)
+		}
+	}
+	snap.Finalizers = removeFinalizer(snap.Finalizers, snapshotFinalizer)
+	_, err := p.updateSnapshot(snap, false)
+	return err
+}
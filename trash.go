@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ActionTypeTrash   = "trash"
+	ActionTypeSweep   = "sweep"
+	ActionTypeRestore = "restore"
+
+	DeleteModeDelete = "delete"
+	DeleteModeTrash  = "trash"
+
+	AnnotationDeleteMode = "local.path.provisioner/delete-mode"
+
+	trashDirName    = ".trash"
+	trashTimeFormat = "20060102150405"
+
+	// trashScript moves the volume directory $1 to the trash entry $2, a
+	// volume which is already gone has nothing left to trash
+	trashScript = `set -eu
+[ -e "$1" ] || exit 0
+mkdir -p "$(dirname "$2")"
+mv "$1" "$2"`
+
+	// restoreScript moves the trash entry $1 back to the volume directory $2
+	restoreScript = `set -eu
+mkdir -p "$(dirname "$2")"
+mv "$1" "$2"`
+
+	// sweepScript purges the entries of the trash directories passed after
+	// the cutoff timestamp $1 which were trashed before it
+	sweepScript = `set -u
+cutoff=$1
+shift
+for trash in "$@"; do
+    for entry in "$trash"/*; do
+        [ -e "$entry" ] || continue
+        stamp=${entry##*-}
+        if [ "$stamp" -lt "$cutoff" ] 2>/dev/null; then
+            echo "purging $entry"
+            rm -rf "$entry"
+        fi
+    done
+done`
+)
+
+var (
+	TrashSweepInterval = 1 * time.Hour
+)
+
+// trashVolume moves the directory of a deleted volume into the trash directory
+// of the configured path holding it, instead of removing it.
+func (p *LocalPathProvisioner) trashVolume(pv *v1.PersistentVolume, path, node string) error {
+	basePath := p.getBasePathForVolume(node, path)
+	trashPath := filepath.Join(basePath, trashDirName, fmt.Sprintf("%s-%s", pv.Name, time.Now().UTC().Format(trashTimeFormat)))
+	helperPod := p.newNodeHelperPod(ActionTypeTrash, node, createMounts(basePath), trashScript, []string{path, trashPath})
+	log := pvLog(pv, node).WithFields(logrus.Fields{
+		logFieldAction:    ActionTypeTrash,
+		logFieldHelperPod: helperPod.Name,
+	})
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		log.Infof("trash volume %v failed: %v", pv.Name, err)
+		return err
+	}
+	if node == "" {
+		log.Infof("Volume %v has been moved to trash at %v", pv.Name, trashPath)
+	} else {
+		log.Infof("Volume %v has been moved to trash at %v:%v", pv.Name, node, trashPath)
+	}
+	return nil
+}
+
+func (p *LocalPathProvisioner) watchAndSweepTrash() {
+	go func() {
+		ticker := time.NewTicker(TrashSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.sweepTrash(); err != nil {
+					logrus.Errorf("failed to sweep trash: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop sweeping trash")
+				return
+			}
+		}
+	}()
+}
+
+// trashInUse tells whether any storage class of this provisioner moves
+// deleted volumes to the trash.
+func (p *LocalPathProvisioner) trashInUse() (bool, error) {
+	scList, err := p.kubeClient.StorageV1().StorageClasses().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, sc := range scList.Items {
+		if sc.Provisioner == p.provisionerName && sc.Parameters["deleteMode"] == DeleteModeTrash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sweepTrash purges the trash entries older than the configured retention on
+// every node, one helper pod per node.
+func (p *LocalPathProvisioner) sweepTrash() error {
+	inUse, err := p.trashInUse()
+	if err != nil || !inUse {
+		return err
+	}
+	pathsByNode, err := p.getPathsByNode()
+	if err != nil {
+		return err
+	}
+
+	p.configMutex.RLock()
+	retention := time.Duration(p.config.TrashRetentionSeconds) * time.Second
+	p.configMutex.RUnlock()
+	cutoff := time.Now().Add(-retention).UTC().Format(trashTimeFormat)
+
+	for node, paths := range pathsByNode {
+		var trashDirs []string
+		for _, path := range paths {
+			trashDirs = append(trashDirs, filepath.Join(path, trashDirName))
+		}
+		output, err := p.sweepNode(node, cutoff, trashDirs)
+		if err != nil {
+			logrus.Errorf("failed to sweep trash on node %v: %v", node, err)
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			if line != "" {
+				logrus.Infof("%v on node %v", line, node)
+			}
+		}
+	}
+	return nil
+}
+
+// sweepNode runs sweepScript on the trash directories of node. It never
+// creates them, the directories missing on the node, which never trashed a
+// volume there, are left out.
+func (p *LocalPathProvisioner) sweepNode(node, cutoff string, trashDirs []string) (string, error) {
+	for len(trashDirs) > 0 {
+		helperPod := p.newNodeHelperPod(ActionTypeSweep, node, existingMounts(trashDirs...), sweepScript, append([]string{cutoff}, trashDirs...))
+		output, err := p.runHelperPod(helperPod)
+		mountErr, ok := err.(*helperMountError)
+		if !ok {
+			return output, err
+		}
+		missing := map[string]bool{}
+		for _, dir := range mountErr.dirs {
+			missing[dir] = true
+		}
+		var remaining []string
+		for _, dir := range trashDirs {
+			if !missing[dir] {
+				remaining = append(remaining, dir)
+			}
+		}
+		if len(remaining) == len(trashDirs) {
+			return "", err
+		}
+		trashDirs = remaining
+	}
+	return "", nil
+}
+
+func TrashCmd() cli.Command {
+	return cli.Command{
+		Name:  "trash",
+		Usage: "Manage volumes moved to the trash by storage classes with deleteMode trash",
+		Subcommands: []cli.Command{
+			{
+				Name:  "restore",
+				Usage: "Restore a trashed volume directory into a new PV pre-bound to a claim",
+				Flags: append(provisionerFlags(),
+					cli.StringFlag{
+						Name:  FlagNode,
+						Usage: "Node holding the trashed directory. Required unless sharedFileSystemPath is used.",
+					},
+					cli.StringFlag{
+						Name:  FlagPath,
+						Usage: "Required. Full path of the trash entry, e.g. /opt/local-path-provisioner/.trash/pvc-xxx-20060102150405",
+					},
+					cli.StringFlag{
+						Name:  FlagPVC,
+						Usage: "Required. The claim (namespace/name) to bind the restored volume to.",
+					},
+					cli.StringFlag{
+						Name:  FlagStorageClass,
+						Usage: "Storage class of the restored volume. Defaults to the one of the claim.",
+					},
+					cli.StringFlag{
+						Name:  FlagCapacity,
+						Usage: "Capacity of the restored volume. Defaults to the request of the claim.",
+					},
+					cli.StringFlag{
+						Name:  FlagVolumeType,
+						Usage: "local or hostPath. Defaults to the defaultVolumeType of the storage class.",
+					},
+				),
+				Action: func(c *cli.Context) {
+					if err := restoreTrash(c); err != nil {
+						logrus.Fatalf("Error restoring volume: %v", err)
+					}
+				},
+			},
+		},
+	}
+}
+
+func restoreTrash(c *cli.Context) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	trashPath := filepath.Clean(c.String(FlagPath))
+	if !filepath.IsAbs(trashPath) || filepath.Base(filepath.Dir(trashPath)) != trashDirName {
+		return fmt.Errorf("invalid flag %v %q, must be an entry of a %v directory", FlagPath, c.String(FlagPath), trashDirName)
+	}
+	namespace, claimName, err := parseNamespacedName(c.String(FlagPVC))
+	if err != nil {
+		return errors.Wrapf(err, "invalid flag %v", FlagPVC)
+	}
+
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return err
+	}
+	var node *v1.Node
+	nodeName := c.String(FlagNode)
+	if !sharedFS {
+		if nodeName == "" {
+			return fmt.Errorf("invalid empty flag %v", FlagNode)
+		}
+		if node, err = p.kubeClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+	}
+
+	pv, err := p.newPreBoundVolume(node, namespace, claimName, c.String(FlagStorageClass), c.String(FlagCapacity), c.String(FlagVolumeType), sharedFS,
+		func(name string) string {
+			basePath := filepath.Dir(filepath.Dir(trashPath))
+			return filepath.Join(basePath, strings.Join([]string{name, namespace, claimName}, "_"))
+		})
+	if err != nil {
+		return err
+	}
+	path, _, err := p.getPathAndNodeForPV(pv)
+	if err != nil {
+		return err
+	}
+
+	basePath := filepath.Dir(filepath.Dir(trashPath))
+	helperPod := p.newNodeHelperPod(ActionTypeRestore, nodeName, createMounts(basePath), restoreScript, []string{trashPath, path})
+	if _, err := p.runHelperPod(helperPod); err != nil {
+		return err
+	}
+	if _, err := p.kubeClient.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{}); err != nil {
+		// put the data back, so the trash entry can be restored again
+		helperPod := p.newNodeHelperPod(ActionTypeRestore, nodeName, existingMounts(basePath), restoreScript, []string{path, trashPath})
+		if _, e := p.runHelperPod(helperPod); e != nil {
+			return errors.Wrapf(err, "failed to create volume %v, and to move %v back to %v: %v", pv.Name, path, trashPath, e)
+		}
+		return errors.Wrapf(err, "failed to create volume %v, %v was moved back", pv.Name, trashPath)
+	}
+	fmt.Printf("Restored %v as volume %v bound to claim %v/%v\n", trashPath, pv.Name, namespace, claimName)
+	return nil
+}
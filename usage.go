@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	ActionTypeUsage = "usage"
+
+	AnnotationUsedBytes     = "local.path.provisioner/used-bytes"
+	AnnotationUsageReported = "local.path.provisioner/usage-reported"
+
+	// usageScript prints the size in KiB and the path of every volume
+	// directory passed as argument, skipping the missing ones
+	usageScript = `set -u
+for dir in "$@"; do
+    if [ -d "$dir" ]; then
+        du -sk "$dir"
+    fi
+done`
+)
+
+type volumeUsage struct {
+	pv       *v1.PersistentVolume
+	node     string
+	used     int64
+	capacity int64
+}
+
+// listProvisionedVolumes returns the PVs that were created by this provisioner.
+func (p *LocalPathProvisioner) listProvisionedVolumes() ([]*v1.PersistentVolume, error) {
+	pvList, err := p.kubeClient.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pvs []*v1.PersistentVolume
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Annotations[annProvisionedBy] == p.provisionerName {
+			pvs = append(pvs, pv)
+		}
+	}
+	return pvs, nil
+}
+
+func (p *LocalPathProvisioner) watchAndReportUsage(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.reportUsage(); err != nil {
+					logrus.Errorf("failed to report volume usage: %v", err)
+				}
+			case <-p.ctx.Done():
+				logrus.Infof("stop reporting volume usage")
+				return
+			}
+		}
+	}()
+}
+
+// reportUsage measures the directory of every provisioned volume, one helper
+// pod per node, and publishes the result as metrics and PV annotations.
+func (p *LocalPathProvisioner) reportUsage() error {
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return err
+	}
+
+	pvsByNode := map[string]map[string]*v1.PersistentVolume{}
+	for _, pv := range pvs {
+		path, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil {
+			logrus.Debugf("skip usage of volume %v: %v", pv.Name, err)
+			continue
+		}
+		if pvsByNode[node] == nil {
+			pvsByNode[node] = map[string]*v1.PersistentVolume{}
+		}
+		pvsByNode[node][path] = pv
+	}
+
+	var usages []volumeUsage
+	for node, pvsByPath := range pvsByNode {
+		var paths []string
+		for path := range pvsByPath {
+			paths = append(paths, path)
+		}
+		used, err := p.measureUsage(node, paths)
+		if err != nil {
+			logrus.Errorf("failed to measure volume usage on node %v: %v", node, err)
+			continue
+		}
+		for path, pv := range pvsByPath {
+			bytes, ok := used[path]
+			if !ok {
+				continue
+			}
+			storage := pv.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+			usages = append(usages, volumeUsage{
+				pv:       pv,
+				node:     node,
+				used:     bytes,
+				capacity: storage.Value(),
+			})
+		}
+	}
+
+	for _, u := range usages {
+		p.recordUsage(u)
+	}
+	// drop the series of volumes which are gone
+	p.usedBytesSeries.flush()
+	p.capacityBytesSeries.flush()
+	return nil
+}
+
+// measureUsage returns the bytes used by each of paths on node.
+func (p *LocalPathProvisioner) measureUsage(node string, paths []string) (map[string]int64, error) {
+	parents := map[string]struct{}{}
+	for _, path := range paths {
+		parents[filepath.Dir(path)] = struct{}{}
+	}
+	var dirs []string
+	for dir := range parents {
+		dirs = append(dirs, dir)
+	}
+
+	helperPod := p.newNodeHelperPod(ActionTypeUsage, node, readOnlyMounts(dirs...), usageScript, paths)
+	output, err := p.runHelperPod(helperPod)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUsage(output), nil
+}
+
+// parseUsage reads the bytes used by each path from the output of du -sk,
+// which separates the size from the path with a tab. Other lines are ignored.
+func parseUsage(output string) map[string]int64 {
+	used := map[string]int64{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		used[fields[1]] = kb * 1024
+	}
+	return used
+}
+
+func (p *LocalPathProvisioner) recordUsage(u volumeUsage) {
+	pv := u.pv
+	namespace, claim := "", ""
+	if pv.Spec.ClaimRef != nil {
+		namespace, claim = pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+	}
+	p.usedBytesSeries.set(float64(u.used), p.provisionerName, namespace, claim, pv.Name, u.node)
+	p.capacityBytesSeries.set(float64(u.capacity), p.provisionerName, namespace, claim, pv.Name, u.node)
+
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q,%q:%q}}}`,
+		AnnotationUsedBytes, strconv.FormatInt(u.used, 10),
+		AnnotationUsageReported, time.Now().UTC().Format(time.RFC3339))
+	_, err := p.kubeClient.CoreV1().PersistentVolumes().Patch(context.TODO(), pv.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		logrus.Errorf("failed to annotate usage of volume %v: %v", pv.Name, err)
+	}
+
+	// on filesystems enforcing quotas the usage never grows past the request.
+	// The event is recorded once when the volume goes past it, the used bytes
+	// annotation of pv still holds the previous report
+	previous, err := strconv.ParseInt(pv.Annotations[AnnotationUsedBytes], 10, 64)
+	exceeded := err == nil && u.capacity > 0 && previous > u.capacity
+	if u.capacity > 0 && u.used > u.capacity && !exceeded && pv.Spec.ClaimRef != nil {
+		p.eventRecorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeWarning, "VolumeUsageExceeded",
+			"volume %v uses %v, more than the requested %v", pv.Name,
+			resource.NewQuantity(u.used, resource.BinarySI), resource.NewQuantity(u.capacity, resource.BinarySI))
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseUsage(t *testing.T) {
+	used := parseUsage("4\t/opt/local-path-provisioner/pvc-1_default_data\n" +
+		"1024\t/opt/local-path-provisioner/models/with space/pvc-2_ml_x\n" +
+		"du: cannot access '/opt/local-path-provisioner/pvc-3_default_gone': No such file or directory\n" +
+		"12 /opt/local-path-provisioner/pvc-4_default_spaces\n" +
+		"\n")
+
+	want := map[string]int64{
+		"/opt/local-path-provisioner/pvc-1_default_data":           4 * 1024,
+		"/opt/local-path-provisioner/models/with space/pvc-2_ml_x": 1024 * 1024,
+	}
+	if len(used) != len(want) {
+		t.Errorf("parseUsage() = %v, want %v", used, want)
+	}
+	for path, bytes := range want {
+		if got, ok := used[path]; !ok || got != bytes {
+			t.Errorf("usage of %q = %v, want %v", path, got, bytes)
+		}
+	}
+}
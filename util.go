@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/yaml"
@@ -38,3 +39,12 @@ func loadHelperPodFile(helperPodYaml string) (*v1.Pod, error) {
 	}
 	return &p, nil
 }
+
+// parseNamespacedName splits a "namespace/name" reference.
+func parseNamespacedName(ref string) (namespace, name string, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid reference %q, must be namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
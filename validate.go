@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// validateClaim checks a claim against its storage class with the rules of
+// Provision which need neither the node nor the volume directory. The
+// admission webhook rejects claims with it, so they fail at creation instead
+// of staying pending.
+func validateClaim(pvc *v1.PersistentVolumeClaim, storageClass *storagev1.StorageClass, sharedFS bool) error {
+	if err := validateAccessModes(pvc.Spec.AccessModes, storageClass, sharedFS); err != nil {
+		return err
+	}
+
+	volumeMode := v1.PersistentVolumeFilesystem
+	if pvc.Spec.VolumeMode != nil {
+		volumeMode = *pvc.Spec.VolumeMode
+	}
+	if pvc.Spec.Selector != nil {
+		if volumeMode == v1.PersistentVolumeBlock {
+			return fmt.Errorf("claim.Spec.Selector is not supported for block volumes")
+		}
+		if pvc.Spec.DataSource != nil {
+			return fmt.Errorf("claim.Spec.Selector cannot be combined with claim.Spec.DataSource")
+		}
+		if _, err := metav1.LabelSelectorAsSelector(pvc.Spec.Selector); err != nil {
+			return fmt.Errorf("invalid claim.Spec.Selector: %v", err)
+		}
+		// the rest applies to new volume directories only
+		return nil
+	}
+	if volumeMode == v1.PersistentVolumeBlock && sharedFS {
+		return fmt.Errorf("block volume mode is not supported with sharedFileSystemPath")
+	}
+	if pvc.Spec.DataSource != nil && volumeMode == v1.PersistentVolumeBlock {
+		return fmt.Errorf("data sources are not supported for block volumes")
+	}
+
+	modelCache := false
+	if isModelCache, ok := storageClass.Parameters["modelCache"]; ok {
+		var err error
+		if modelCache, err = strconv.ParseBool(isModelCache); err != nil {
+			return fmt.Errorf("invalid modelCache parameter %q of storage class %v: %v", isModelCache, storageClass.Name, err)
+		}
+		if _, ok := storageClass.Parameters["registry"]; !ok {
+			return fmt.Errorf("The registry parameter must be set")
+		}
+		if _, ok := storageClass.Parameters["storeType"]; !ok {
+			return fmt.Errorf("The storeType parameter must be set")
+		}
+		if modelCache && volumeMode == v1.PersistentVolumeBlock {
+			return fmt.Errorf("block volume mode is not supported for model cache")
+		}
+	}
+	if pathPattern, ok := storageClass.Parameters["pathPattern"]; ok {
+		if _, err := expandPathPattern(pathPattern, pvc, modelCache); err != nil {
+			return err
+		}
+	}
+	deleteMode := storageClass.Parameters["deleteMode"]
+	switch deleteMode {
+	case "", DeleteModeDelete, DeleteModeTrash:
+	default:
+		return fmt.Errorf("invalid deleteMode parameter %q, must be %v or %v", deleteMode, DeleteModeDelete, DeleteModeTrash)
+	}
+
+	if volumeMode == v1.PersistentVolumeFilesystem {
+		if _, err := parseVolumePermissions(storageClass, pvc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandPathPattern returns the directory pathPattern places the volume of pvc
+// in, relative to the configured path, or "" if the volume goes directly into
+// the configured path. The expansion must stay below the configured path, as
+// the directory is deleted with the volume. Model cache volumes are named after
+// the model, so every label and annotation they refer to must be set.
+func expandPathPattern(pathPattern string, pvc *v1.PersistentVolumeClaim, modelCache bool) (string, error) {
+	metadata := newPVCMetadata(pvc)
+	if missing := metadata.missingKeys(pathPattern); modelCache && len(missing) > 0 {
+		return "", fmt.Errorf("pathPattern %q of the model cache needs %v of claim %v/%v", pathPattern, strings.Join(missing, ", "), pvc.Namespace, pvc.Name)
+	}
+	customPath := metadata.stringParser(pathPattern)
+	if customPath == "" {
+		return "", nil
+	}
+	rel := filepath.Clean(strings.TrimPrefix(customPath, "/"))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("pathPattern %q expands to %q for claim %v/%v, which is not a directory below the configured path", pathPattern, customPath, pvc.Namespace, pvc.Name)
+	}
+	if metadata.emptyPath {
+		return "", nil
+	}
+	return customPath, nil
+}
+
+func newPVCMetadata(pvc *v1.PersistentVolumeClaim) *pvcMetadata {
+	return &pvcMetadata{
+		data: map[string]string{
+			"name":      pvc.Name,
+			"namespace": pvc.Namespace,
+		},
+		labels:      pvc.Labels,
+		annotations: pvc.Annotations,
+		emptyPath:   true,
+	}
+}
+
+// missingKeys returns the labels and annotations str refers to which are not
+// set.
+func (meta *pvcMetadata) missingKeys(str string) []string {
+	var missing []string
+	for _, r := range pattern.FindAllStringSubmatch(str, -1) {
+		switch r[2] {
+		case "labels":
+			if _, ok := meta.labels[r[3]]; !ok {
+				missing = append(missing, "label "+r[3])
+			}
+		case "annotations":
+			if _, ok := meta.annotations[r[3]]; !ok {
+				missing = append(missing, "annotation "+r[3])
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateClaim(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	modelCache := map[string]string{"modelCache": "true", "registry": "registry.local", "storeType": "oras"}
+	withParams := func(params map[string]string, extra map[string]string) map[string]string {
+		merged := map[string]string{}
+		for k, v := range params {
+			merged[k] = v
+		}
+		for k, v := range extra {
+			merged[k] = v
+		}
+		return merged
+	}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		sharedFS    bool
+		accessModes []v1.PersistentVolumeAccessMode
+		volumeMode  *v1.PersistentVolumeMode
+		selector    *metav1.LabelSelector
+		dataSource  *v1.TypedLocalObjectReference
+		wantErr     bool
+	}{
+		{
+			name: "plain claim",
+		},
+		{
+			name:        "ReadWriteMany on a node",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			wantErr:     true,
+		},
+		{
+			name:        "ReadWriteMany on a shared filesystem",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			sharedFS:    true,
+		},
+		{
+			name:       "block volume",
+			volumeMode: &block,
+		},
+		{
+			name:       "block volume on a shared filesystem",
+			volumeMode: &block,
+			sharedFS:   true,
+			wantErr:    true,
+		},
+		{
+			name:       "block volume with a data source",
+			volumeMode: &block,
+			dataSource: &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "source"},
+			wantErr:    true,
+		},
+		{
+			name:     "selector",
+			selector: &metav1.LabelSelector{MatchLabels: map[string]string{"dataset": "imagenet"}},
+		},
+		{
+			name:       "selector with a block volume",
+			selector:   &metav1.LabelSelector{MatchLabels: map[string]string{"dataset": "imagenet"}},
+			volumeMode: &block,
+			wantErr:    true,
+		},
+		{
+			name:       "selector with a data source",
+			selector:   &metav1.LabelSelector{MatchLabels: map[string]string{"dataset": "imagenet"}},
+			dataSource: &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "source"},
+			wantErr:    true,
+		},
+		{
+			name: "invalid selector",
+			selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "dataset", Operator: "Matches"},
+			}},
+			wantErr: true,
+		},
+		{
+			name:   "model cache",
+			params: modelCache,
+		},
+		{
+			name:    "model cache without registry",
+			params:  map[string]string{"modelCache": "true", "storeType": "oras"},
+			wantErr: true,
+		},
+		{
+			name:    "model cache without storeType",
+			params:  map[string]string{"modelCache": "true", "registry": "registry.local"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid modelCache",
+			params:  withParams(modelCache, map[string]string{"modelCache": "sometimes"}),
+			wantErr: true,
+		},
+		{
+			name:       "model cache block volume",
+			params:     modelCache,
+			volumeMode: &block,
+			wantErr:    true,
+		},
+		{
+			name:    "model cache pathPattern with missing annotations",
+			params:  withParams(modelCache, map[string]string{"pathPattern": "${.PVC.annotations.models/storage-path}"}),
+			wantErr: true,
+		},
+		{
+			name:   "pathPattern with missing annotations",
+			params: map[string]string{"pathPattern": "${.PVC.namespace}/${.PVC.annotations.models/storage-path}"},
+		},
+		{
+			name:    "pathPattern with parent directories",
+			params:  map[string]string{"pathPattern": "../${.PVC.namespace}/${.PVC.name}"},
+			wantErr: true,
+		},
+		{
+			name:   "trash deleteMode",
+			params: map[string]string{"deleteMode": DeleteModeTrash},
+		},
+		{
+			name:    "invalid deleteMode",
+			params:  map[string]string{"deleteMode": "archive"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid permissions",
+			params:  map[string]string{paramUID: "nobody"},
+			wantErr: true,
+		},
+		{
+			name:       "permissions are not checked for block volumes",
+			params:     map[string]string{paramUID: "nobody"},
+			volumeMode: &block,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "local-path"},
+				Parameters: tt.params,
+			}
+			accessModes := tt.accessModes
+			if accessModes == nil {
+				accessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+			}
+			pvc := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data"},
+				Spec: v1.PersistentVolumeClaimSpec{
+					AccessModes: accessModes,
+					VolumeMode:  tt.volumeMode,
+					Selector:    tt.selector,
+					DataSource:  tt.dataSource,
+				},
+			}
+			err := validateClaim(pvc, sc, tt.sharedFS)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateClaim() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	volumeModeLocal  = "local"
+	volumeModeShared = "shared"
+)
+
+// VolumeInfo tells where a provisioned volume lives and how it is managed.
+type VolumeInfo struct {
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace,omitempty"`
+	Claim         string `json:"claim,omitempty"`
+	StorageClass  string `json:"storageClass,omitempty"`
+	Phase         string `json:"phase"`
+	Capacity      string `json:"capacity,omitempty"`
+	ReclaimPolicy string `json:"reclaimPolicy"`
+	// local for a directory on a node, shared for sharedFileSystemPath
+	Mode       string          `json:"mode"`
+	VolumeType string          `json:"volumeType"`
+	VolumeMode string          `json:"volumeMode"`
+	Node       string          `json:"node,omitempty"`
+	BasePath   string          `json:"basePath,omitempty"`
+	Path       string          `json:"path"`
+	ModelCache *ModelCacheInfo `json:"modelCache,omitempty"`
+	// nil when the directory was not checked or the check failed
+	Exists *bool `json:"exists,omitempty"`
+}
+
+// ModelCacheInfo is where the model of a model cache volume comes from.
+type ModelCacheInfo struct {
+	Registry  string `json:"registry"`
+	StoreType string `json:"storeType"`
+	Model     string `json:"model,omitempty"`
+}
+
+// describeVolumes builds the VolumeInfo of pvs, checking the existence of
+// their directories with one helper pod per node when check is set.
+func (p *LocalPathProvisioner) describeVolumes(pvs []*v1.PersistentVolume, check bool) ([]*VolumeInfo, error) {
+	scList, err := p.kubeClient.StorageV1().StorageClasses().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	storageClasses := map[string]*storagev1.StorageClass{}
+	for i := range scList.Items {
+		storageClasses[scList.Items[i].Name] = &scList.Items[i]
+	}
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*VolumeInfo
+	var modelClaims []*VolumeInfo
+	pathsByNode := map[string][]string{}
+	infoByPath := map[string]map[string]*VolumeInfo{}
+	for _, pv := range pvs {
+		info := &VolumeInfo{
+			Name:          pv.Name,
+			StorageClass:  pv.Spec.StorageClassName,
+			Phase:         string(pv.Status.Phase),
+			ReclaimPolicy: string(pv.Spec.PersistentVolumeReclaimPolicy),
+			Mode:          volumeModeLocal,
+			VolumeType:    "hostPath",
+			VolumeMode:    string(v1.PersistentVolumeFilesystem),
+		}
+		infos = append(infos, info)
+		info.Namespace, info.Claim = pvClaim(pv)
+		if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			info.Capacity = capacity.String()
+		}
+		if sharedFS {
+			info.Mode = volumeModeShared
+		}
+		if pv.Spec.Local != nil {
+			info.VolumeType = "local"
+		}
+		if isBlockVolume(pv) {
+			info.VolumeMode = string(v1.PersistentVolumeBlock)
+		}
+		path, node, err := p.getPathAndNodeForPV(pv)
+		if err != nil {
+			logrus.Warnf("Volume %v: %v", pv.Name, err)
+			continue
+		}
+		path = filepath.Clean(path)
+		info.Node, info.Path = node, path
+		info.BasePath = p.getBasePathForVolume(node, path)
+		if sc, ok := storageClasses[pv.Spec.StorageClassName]; ok {
+			if modelCache, _ := strconv.ParseBool(sc.Parameters["modelCache"]); modelCache {
+				info.ModelCache = &ModelCacheInfo{
+					Registry:  sc.Parameters["registry"],
+					StoreType: sc.Parameters["storeType"],
+				}
+				if info.Claim != "" {
+					modelClaims = append(modelClaims, info)
+				}
+			}
+		}
+		if infoByPath[node] == nil {
+			infoByPath[node] = map[string]*VolumeInfo{}
+		}
+		pathsByNode[node] = append(pathsByNode[node], path)
+		infoByPath[node][path] = info
+	}
+
+	if len(modelClaims) > 0 {
+		// one list for all the model cache claims instead of one get each
+		pvcList, err := p.kubeClient.CoreV1().PersistentVolumeClaims("").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		models := map[string]string{}
+		for _, pvc := range pvcList.Items {
+			models[pvc.Namespace+"/"+pvc.Name] = pvc.Annotations["model/registry"]
+		}
+		for _, info := range modelClaims {
+			info.ModelCache.Model = models[info.Namespace+"/"+info.Claim]
+		}
+	}
+
+	if check {
+		// scanNode mounts the parent directories read-only and creates
+		// nothing, a volume under a missing parent is reported missing
+		for node, paths := range pathsByNode {
+			sort.Strings(paths)
+			scan, err := p.scanNode(node, nil, paths)
+			if err != nil {
+				// the volumes of the other nodes are still worth checking
+				logrus.Errorf("failed to check the volume directories on node %v: %v", node, err)
+				continue
+			}
+			for _, path := range paths {
+				exists := !scan.missing[path]
+				infoByPath[node][path].Exists = &exists
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func printVolumeList(w io.Writer, infos []*VolumeInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCLAIM\tNODE\tPATH\tMODE\tRECLAIM POLICY\tEXISTS")
+	for _, info := range infos {
+		claim := ""
+		if info.Claim != "" {
+			claim = info.Namespace + "/" + info.Claim
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", info.Name, orNone(claim), orNone(info.Node), orNone(info.Path),
+			info.Mode, info.ReclaimPolicy, existsString(info.Exists))
+	}
+	tw.Flush()
+}
+
+func printVolumeInfo(w io.Writer, info *VolumeInfo) {
+	claim := ""
+	if info.Claim != "" {
+		claim = info.Namespace + "/" + info.Claim
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%v\n", info.Name)
+	fmt.Fprintf(tw, "Claim:\t%v\n", orNone(claim))
+	fmt.Fprintf(tw, "Storage class:\t%v\n", orNone(info.StorageClass))
+	fmt.Fprintf(tw, "Phase:\t%v\n", orNone(info.Phase))
+	fmt.Fprintf(tw, "Capacity:\t%v\n", orNone(info.Capacity))
+	fmt.Fprintf(tw, "Reclaim policy:\t%v\n", info.ReclaimPolicy)
+	fmt.Fprintf(tw, "Mode:\t%v\n", info.Mode)
+	fmt.Fprintf(tw, "Volume type:\t%v\n", info.VolumeType)
+	fmt.Fprintf(tw, "Volume mode:\t%v\n", info.VolumeMode)
+	fmt.Fprintf(tw, "Node:\t%v\n", orNone(info.Node))
+	fmt.Fprintf(tw, "Base path:\t%v\n", orNone(info.BasePath))
+	fmt.Fprintf(tw, "Directory:\t%v\n", orNone(info.Path))
+	fmt.Fprintf(tw, "Exists:\t%v\n", existsString(info.Exists))
+	if m := info.ModelCache; m != nil {
+		fmt.Fprintf(tw, "Model cache:\t\n")
+		fmt.Fprintf(tw, "  Registry:\t%v\n", m.Registry)
+		fmt.Fprintf(tw, "  Store type:\t%v\n", m.StoreType)
+		fmt.Fprintf(tw, "  Model:\t%v\n", orNone(m.Model))
+	}
+	tw.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+func existsString(exists *bool) string {
+	if exists == nil {
+		return "unknown"
+	}
+	return strconv.FormatBool(*exists)
+}
+
+func VolumesCmd() cli.Command {
+	flags := append(provisionerFlags(),
+		cli.StringFlag{
+			Name:  FlagFormat,
+			Usage: "Output format, text or json.",
+			Value: "text",
+		},
+		cli.BoolTFlag{
+			Name:  FlagCheck,
+			Usage: "Check that the volume directories exist with a helper pod per node. --" + FlagCheck + "=false skips it.",
+		},
+	)
+	return cli.Command{
+		Name:  "volumes",
+		Usage: "Show where the provisioned volumes live",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the volumes of the provisioner",
+				Flags: flags,
+				Action: func(c *cli.Context) {
+					if err := listVolumes(c, os.Stdout); err != nil {
+						logrus.Fatalf("Error listing volumes: %v", err)
+					}
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show the details of a volume",
+				ArgsUsage: "<pv>",
+				Flags:     flags,
+				Action: func(c *cli.Context) {
+					if err := inspectVolume(c, os.Stdout); err != nil {
+						logrus.Fatalf("Error inspecting volume: %v", err)
+					}
+				},
+			},
+		},
+	}
+}
+
+func listVolumes(c *cli.Context, out io.Writer) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	format := c.String(FlagFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid flag %v %q, must be text or json", FlagFormat, format)
+	}
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	pvs, err := p.listProvisionedVolumes()
+	if err != nil {
+		return err
+	}
+	infos, err := p.describeVolumes(pvs, c.BoolT(FlagCheck))
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		if infos == nil {
+			infos = []*VolumeInfo{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
+	printVolumeList(out, infos)
+	return nil
+}
+
+func inspectVolume(c *cli.Context, out io.Writer) error {
+	ctx, cancelFn := context.WithCancel(context.TODO())
+	defer cancelFn()
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected the name of a single PV, got %d arguments", c.NArg())
+	}
+	format := c.String(FlagFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid flag %v %q, must be text or json", FlagFormat, format)
+	}
+	p, err := newProvisionerFromFlags(ctx, c)
+	if err != nil {
+		return err
+	}
+	pv, err := p.kubeClient.CoreV1().PersistentVolumes().Get(context.TODO(), c.Args().First(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Annotations[annProvisionedBy] != p.provisionerName {
+		return fmt.Errorf("volume %v was not provisioned by %v", pv.Name, p.provisionerName)
+	}
+	infos, err := p.describeVolumes([]*v1.PersistentVolume{pv}, c.BoolT(FlagCheck))
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos[0])
+	}
+	printVolumeInfo(out, infos[0])
+	return nil
+}
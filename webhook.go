@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+const (
+	webhookPath = "/validate"
+
+	// maxAdmissionReviewSize bounds the body of a review, a claim is small
+	maxAdmissionReviewSize = 1 << 20
+)
+
+// admissionReview is the admission.k8s.io/v1 AdmissionReview, limited to the
+// fields a validating webhook needs. The admission API is not vendored.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionRequest  `json:"request,omitempty"`
+	Response        *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID                   `json:"uid"`
+	Kind      metav1.GroupVersionKind     `json:"kind"`
+	Operation string                      `json:"operation"`
+	Namespace string                      `json:"namespace,omitempty"`
+	Name      string                      `json:"name,omitempty"`
+	Object    runtime.RawExtension        `json:"object,omitempty"`
+	Resource  metav1.GroupVersionResource `json:"resource"`
+}
+
+type admissionResponse struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"result,omitempty"`
+}
+
+// webhookServer rejects the claims on the storage classes of provisioners
+// which Provision would fail, at creation instead of leaving them pending.
+type webhookServer struct {
+	kubeClient   clientset.Interface
+	provisioners map[string]*LocalPathProvisioner
+}
+
+func newWebhookServer(provisioners []*LocalPathProvisioner) *webhookServer {
+	s := &webhookServer{kubeClient: provisioners[0].kubeClient, provisioners: map[string]*LocalPathProvisioner{}}
+	for _, p := range provisioners {
+		s.provisioners[p.provisionerName] = p
+	}
+	return s
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionReviewSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionResponse{UID: review.Request.UID, Allowed: true}
+	if err := s.review(r.Context(), review.Request); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	review.Request = nil
+	review.Response = response
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// review returns why the claim of req is rejected. Claims of other storage
+// classes are left alone, and so are the ones which cannot be checked, e.g.
+// when the storage class does not exist yet.
+func (s *webhookServer) review(ctx context.Context, req *admissionRequest) error {
+	if req.Kind.Kind != "PersistentVolumeClaim" || req.Operation != "CREATE" {
+		return nil
+	}
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(req.Object.Raw, pvc); err != nil {
+		return fmt.Errorf("invalid claim: %v", err)
+	}
+	if pvc.Namespace == "" {
+		pvc.Namespace = req.Namespace
+	}
+	className := ""
+	if pvc.Spec.StorageClassName != nil {
+		className = *pvc.Spec.StorageClassName
+	} else if name, ok := pvc.Annotations[v1.BetaStorageClassAnnotation]; ok {
+		className = name
+	}
+	if className == "" || pvc.Spec.VolumeName != "" {
+		// the default class is assigned after validation, a claim of an
+		// existing PV is not provisioned
+		return nil
+	}
+	storageClass, err := s.kubeClient.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		logrus.Debugf("Admitting claim %v/%v unchecked, failed to get storage class %v: %v", pvc.Namespace, pvc.Name, className, err)
+		return nil
+	}
+	p, ok := s.provisioners[storageClass.Provisioner]
+	if !ok {
+		return nil
+	}
+	sharedFS, err := p.isSharedFilesystem()
+	if err != nil {
+		return nil
+	}
+	if err := validateClaim(pvc, storageClass, sharedFS); err != nil {
+		volumeLog(pvc.Namespace, pvc.Name, "", "").Infof("Rejected claim of storage class %v: %v", className, err)
+		return fmt.Errorf("storage class %v cannot provision this claim: %v", className, err)
+	}
+	return nil
+}
+
+// certificateLoader serves the certificate in certFile and keyFile, reloaded
+// when they change, e.g. when cert-manager renews the mounted secret.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	modTime := time.Time{}
+	for _, file := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if l.cert != nil {
+				return l.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if l.cert != nil && !modTime.After(l.modTime) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			logrus.Errorf("failed to reload the webhook certificate, keeping the previous one: %v", err)
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	l.cert, l.modTime = &cert, modTime
+	return l.cert, nil
+}
+
+// serveWebhook serves the admission webhook over TLS on address until ctx is
+// done.
+func serveWebhook(ctx context.Context, address, certFile, keyFile string, provisioners []*LocalPathProvisioner) error {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := loader.getCertificate(nil); err != nil {
+		return fmt.Errorf("failed to load the webhook certificate: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, newWebhookServer(provisioners))
+	server := &http.Server{
+		Addr:      address,
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: loader.getCertificate, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		logrus.Infof("Serving the admission webhook on %v%v", address, webhookPath)
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			logrus.Fatalf("failed to serve the admission webhook on %v: %v", address, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}